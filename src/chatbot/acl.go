@@ -0,0 +1,245 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Role is a level of access to the bot's commands.
+type Role int
+
+const (
+	// RoleBanned can't run any commands.
+	RoleBanned Role = iota
+	// RoleUser can run ordinary commands. It is the default role.
+	RoleUser
+	// RoleOperator can run commands which manage the bot.
+	RoleOperator
+	// RoleAdmin can run every command, including managing access.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleBanned:   "banned",
+	RoleUser:     "user",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+// String returns the name of the role.
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole converts a role name to a Role.
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if strings.EqualFold(n, name) {
+			return r, nil
+		}
+	}
+
+	return RoleUser, fmt.Errorf("unknown role %q", name)
+}
+
+// RoleRequirer is implemented by commands which can only be run by users
+// with at least the returned role. Other commands require RoleUser.
+type RoleRequirer interface {
+	RequiredRole() Role
+}
+
+// requiredRole returns the role needed to run cmd.
+func requiredRole(cmd Command) Role {
+	if rr, ok := cmd.(RoleRequirer); ok {
+		return rr.RequiredRole()
+	}
+
+	return RoleUser
+}
+
+// Identity identifies the sender of an event across gateways, e.g.
+// "slack:U024BE7LH" or "irc:bryanl!~bryan@example.com". Local chat
+// identities are nicknames, which any client can take once they are free,
+// so roles granted to them are only fit for development.
+func Identity(e Event) string {
+	return e.Gateway.Name() + ":" + e.Message.UserID
+}
+
+// ACL maps user identities to roles. Identities may contain * wildcards.
+// An exact match takes precedence over wildcards. When several wildcards
+// match, a ban wins, and otherwise the most privileged role does.
+type ACL struct {
+	mu    sync.RWMutex
+	roles map[string]Role
+}
+
+// NewACL creates an instance of ACL.
+func NewACL() *ACL {
+	return &ACL{
+		roles: make(map[string]Role),
+	}
+}
+
+// Grant gives identity a role.
+func (a *ACL) Grant(identity string, role Role) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.roles[identity] = role
+}
+
+// Revoke removes the role given to identity. It returns false if identity
+// had not been given a role.
+func (a *ACL) Revoke(identity string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.roles[identity]
+	delete(a.roles, identity)
+	return ok
+}
+
+// Role returns the role of identity.
+func (a *ACL) Role(identity string) Role {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if role, ok := a.roles[identity]; ok {
+		return role
+	}
+
+	role, matched := RoleUser, false
+	for pattern, r := range a.roles {
+		if !strings.Contains(pattern, "*") || !wildcardMatch(pattern, identity) {
+			continue
+		}
+
+		switch {
+		case r == RoleBanned:
+			return RoleBanned
+		case !matched || r > role:
+			role, matched = r, true
+		}
+	}
+
+	return role
+}
+
+// Allowed returns true if the sender of the event may run cmd.
+func (a *ACL) Allowed(e Event, cmd Command) bool {
+	role := a.Role(Identity(e))
+	return role != RoleBanned && role >= requiredRole(cmd)
+}
+
+// wildcardMatch returns true if s matches pattern, where * in pattern
+// matches any run of characters.
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(s, part)
+		if idx == -1 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// grantCommand gives a user a role.
+type grantCommand struct {
+	acl *ACL
+}
+
+var _ Command = (*grantCommand)(nil)
+var _ Describer = (*grantCommand)(nil)
+var _ ArgSpecifier = (*grantCommand)(nil)
+var _ RoleRequirer = (*grantCommand)(nil)
+
+func (grantCommand) Name() string       { return "grant" }
+func (grantCommand) Aliases() []string  { return nil }
+func (grantCommand) Usage() string      { return "" }
+func (grantCommand) Synopsis() string   { return "Give a user a role." }
+func (grantCommand) RequiredRole() Role { return RoleAdmin }
+
+func (grantCommand) Examples() []string {
+	return []string{"grant slack:U024BE7LH operator", `grant "irc:*!*@spammer.example.com" banned`}
+}
+
+func (grantCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{Name: "identity", Help: "gateway:user, which may contain * wildcards."},
+			{Name: "role", Help: "One of admin, operator, user or banned."},
+		},
+	}
+}
+
+func (g grantCommand) Handle(args Args) (State, error) {
+	role, err := ParseRole(args.String("role"))
+	if err != nil {
+		return nil, &ArgError{msg: err.Error()}
+	}
+
+	identity := args.String("identity")
+	return func(e Event) State {
+		g.acl.Grant(identity, role)
+		e.Reply(fmt.Sprintf("%s is now %s", identity, role))
+		return nil
+	}, nil
+}
+
+// revokeCommand removes the role given to a user.
+type revokeCommand struct {
+	acl *ACL
+}
+
+var _ Command = (*revokeCommand)(nil)
+var _ Describer = (*revokeCommand)(nil)
+var _ ArgSpecifier = (*revokeCommand)(nil)
+var _ RoleRequirer = (*revokeCommand)(nil)
+
+func (revokeCommand) Name() string       { return "revoke" }
+func (revokeCommand) Aliases() []string  { return nil }
+func (revokeCommand) Usage() string      { return "" }
+func (revokeCommand) Synopsis() string   { return "Remove the role given to a user." }
+func (revokeCommand) RequiredRole() Role { return RoleAdmin }
+
+func (revokeCommand) Examples() []string {
+	return []string{"revoke slack:U024BE7LH"}
+}
+
+func (revokeCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{Name: "identity", Help: "An identity previously given a role."},
+		},
+	}
+}
+
+func (r revokeCommand) Handle(args Args) (State, error) {
+	identity := args.String("identity")
+	return func(e Event) State {
+		if !r.acl.Revoke(identity) {
+			e.Reply(identity + " has no role to revoke")
+			return nil
+		}
+
+		e.Reply(fmt.Sprintf("%s is now %s", identity, r.acl.Role(identity)))
+		return nil
+	}, nil
+}
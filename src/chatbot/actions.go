@@ -0,0 +1,142 @@
+package chatbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultActionTimeout is how long offered buttons can be clicked.
+	defaultActionTimeout = time.Hour
+)
+
+// Action is a button offered with a reply.
+type Action struct {
+	// Name is the event's message text when the button is clicked.
+	Name string
+	// Label is shown on the button.
+	Label string
+}
+
+// ActionReplier is implemented by gateways which can show buttons with a
+// message. Clicks are sent as ActionEvents with the message's callback ID.
+type ActionReplier interface {
+	ReplyActions(m Message, msg, callbackID string, actions []Action) error
+}
+
+// offer is a state waiting for a click on one of the buttons offered with
+// a reply.
+type offer struct {
+	next State
+	// role is the least role allowed to click the buttons: the role of
+	// the user they were offered to.
+	role    Role
+	expires time.Time
+}
+
+// offers tracks the states waiting for button clicks, by callback ID.
+type offers struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	offered map[string]offer
+}
+
+// newOffers creates an instance of offers.
+func newOffers(timeout time.Duration) *offers {
+	return &offers{
+		timeout: timeout,
+		offered: make(map[string]offer),
+	}
+}
+
+// Add stores next as the handler for clicks and returns the callback ID
+// the buttons are sent with.
+func (o *offers) Add(next State, role Role) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	o.expire(now)
+	o.offered[id] = offer{
+		next:    next,
+		role:    role,
+		expires: now.Add(o.timeout),
+	}
+
+	return id, nil
+}
+
+// Lookup returns the offer a click belongs to. Offers aren't removed, so
+// buttons can be clicked again until they expire.
+func (o *offers) Lookup(callbackID string) (offer, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire(time.Now())
+	of, ok := o.offered[callbackID]
+	return of, ok
+}
+
+// expire removes offers which have timed out. The caller must hold o.mu.
+func (o *offers) expire(now time.Time) {
+	for id, of := range o.offered {
+		if now.After(of.expires) {
+			delete(o.offered, id)
+		}
+	}
+}
+
+// Offer replies with msg and buttons for actions. A click is handled by
+// next, with the clicked action's name as the event's message text. On
+// gateways without buttons only msg is sent.
+func Offer(msg string, actions []Action, next State) State {
+	return func(e Event) State {
+		ar, ok := e.Gateway.(ActionReplier)
+		if !ok || e.offers == nil {
+			e.Reply(msg)
+			return nil
+		}
+
+		role := RoleUser
+		if e.brain != nil {
+			role = e.brain.acl.Role(Identity(e))
+		}
+
+		id, err := e.offers.Add(next, role)
+		if err != nil {
+			return errorState(err)
+		}
+
+		e.replied()
+		if err := ar.ReplyActions(e.Message, msg, id, actions); err != nil {
+			return errorState(err)
+		}
+		return nil
+	}
+}
+
+// actionState handles a button click with the state it was offered with.
+func actionState(o *offers, acl *ACL) State {
+	return func(e Event) State {
+		of, ok := o.Lookup(e.Message.CallbackID)
+		if !ok {
+			e.Reply("that button has expired")
+			return nil
+		}
+
+		if acl.Role(Identity(e)) < of.role {
+			e.Reply("you are not allowed to use that button")
+			return nil
+		}
+
+		return of.next
+	}
+}
@@ -0,0 +1,102 @@
+package chatbot
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Addresser is implemented by gateways which recognize messages addressed
+// to the bot by name or mention, e.g. "TwikiTheBot: weather 90210".
+type Addresser interface {
+	// Addressed returns the rest of msg and true if msg starts by
+	// addressing the bot.
+	Addressed(msg string) (string, bool)
+}
+
+// addressed checks if msg is addressed to the bot on gw.
+func addressed(gw Gateway, msg string) (string, bool) {
+	if a, ok := gw.(Addresser); ok {
+		return a.Addressed(msg)
+	}
+
+	return "", false
+}
+
+// stripAddress removes a leading "name:", "name," or "@name" from msg.
+// A bare "name " isn't an address, so chatter which starts with the bot's
+// name, e.g. "TwikiTheBot is broken again", isn't taken as a command.
+// Names are matched case insensitively.
+func stripAddress(msg string, names ...string) (string, bool) {
+	text := strings.TrimPrefix(msg, "@")
+	mention := text != msg
+
+	for _, name := range names {
+		if name == "" || len(text) < len(name) || !strings.EqualFold(text[:len(name)], name) {
+			continue
+		}
+
+		rest := text[len(name):]
+		switch {
+		case rest == "":
+			return "", true
+		case rest[0] == ':' || rest[0] == ',':
+			return strings.TrimSpace(rest[1:]), true
+		case mention && unicode.IsSpace(rune(rest[0])):
+			return strings.TrimSpace(rest), true
+		}
+	}
+
+	return "", false
+}
+
+// prefixKey identifies a channel on a gateway.
+type prefixKey struct {
+	gateway string
+	channel Destination
+}
+
+// prefixes are the command prefixes for gateways and channels.
+type prefixes struct {
+	mu       sync.RWMutex
+	fallback string
+	prefixes map[prefixKey]string
+}
+
+// newPrefixes creates an instance of prefixes.
+func newPrefixes(fallback string) *prefixes {
+	return &prefixes{
+		fallback: fallback,
+		prefixes: make(map[prefixKey]string),
+	}
+}
+
+// Set sets the prefix for a channel on a gateway. An empty channel sets
+// the prefix for the whole gateway, and an empty gateway sets the default
+// prefix.
+func (p *prefixes) Set(gateway string, channel Destination, prefix string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if gateway == "" {
+		p.fallback = prefix
+		return
+	}
+
+	p.prefixes[prefixKey{gateway: gateway, channel: channel}] = prefix
+}
+
+// For returns the prefix for a channel on a gateway.
+func (p *prefixes) For(gateway string, channel Destination) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if prefix, ok := p.prefixes[prefixKey{gateway: gateway, channel: channel}]; ok {
+		return prefix
+	}
+	if prefix, ok := p.prefixes[prefixKey{gateway: gateway}]; ok {
+		return prefix
+	}
+
+	return p.fallback
+}
@@ -0,0 +1,420 @@
+package chatbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ArgType is the type of a command argument or flag.
+type ArgType int
+
+const (
+	// StringArg is a string argument.
+	StringArg ArgType = iota
+	// IntArg is an integer argument.
+	IntArg
+	// DurationArg is a duration argument, e.g. "1h30m".
+	DurationArg
+	// BoolArg is a boolean flag. It may be given without a value.
+	BoolArg
+)
+
+// Arg declares a positional command argument.
+type Arg struct {
+	Name string
+	Type ArgType
+	Help string
+	// Optional arguments may be omitted. They must follow required
+	// arguments.
+	Optional bool
+	// Variadic arguments collect the remaining arguments. Only the last
+	// argument may be variadic.
+	Variadic bool
+}
+
+// Flag declares a command flag given as --name=value.
+type Flag struct {
+	Name    string
+	Type    ArgType
+	Help    string
+	Default string
+}
+
+// ArgSpec declares the arguments and flags a command accepts.
+type ArgSpec struct {
+	Args  []Arg
+	Flags []Flag
+}
+
+// ArgSpecifier is implemented by commands which declare their arguments.
+// Their input is validated against the spec before Handle is called.
+type ArgSpecifier interface {
+	ArgSpec() ArgSpec
+}
+
+// validate checks that the spec can be parsed: names are unique, required
+// arguments come before optional ones, only the last argument is variadic
+// and flag defaults are valid.
+func (s ArgSpec) validate() error {
+	names := make(map[string]bool)
+	optional := false
+	for i, a := range s.Args {
+		if names[a.Name] {
+			return fmt.Errorf("argument <%s> is declared twice", a.Name)
+		}
+		names[a.Name] = true
+
+		if a.Optional {
+			optional = true
+		} else if optional {
+			return fmt.Errorf("required argument <%s> follows an optional argument", a.Name)
+		}
+		if a.Variadic && i != len(s.Args)-1 {
+			return fmt.Errorf("variadic argument <%s> is not the last argument", a.Name)
+		}
+	}
+
+	for _, f := range s.Flags {
+		if names[f.Name] {
+			return fmt.Errorf("flag --%s is declared twice", f.Name)
+		}
+		names[f.Name] = true
+
+		if f.Default == "" {
+			continue
+		}
+		if _, err := f.Type.parse(f.Default); err != nil {
+			return fmt.Errorf("invalid default for flag --%s: %v", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Usage describes the spec's arguments, e.g. "[--units=<string>] <zip>".
+func (s ArgSpec) Usage() string {
+	var parts []string
+	for _, f := range s.Flags {
+		if f.Type == BoolArg {
+			parts = append(parts, "[--"+f.Name+"]")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("[--%s=<%s>]", f.Name, f.Type))
+	}
+
+	for _, a := range s.Args {
+		part := "<" + a.Name + ">"
+		if a.Variadic {
+			part += "..."
+		}
+		if a.Optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// String returns the name of the type.
+func (t ArgType) String() string {
+	switch t {
+	case IntArg:
+		return "int"
+	case DurationArg:
+		return "duration"
+	case BoolArg:
+		return "bool"
+	default:
+		return "string"
+	}
+}
+
+// parse converts s to a value of type t.
+func (t ArgType) parse(s string) (interface{}, error) {
+	switch t {
+	case IntArg:
+		return strconv.Atoi(s)
+	case DurationArg:
+		return time.ParseDuration(s)
+	case BoolArg:
+		return strconv.ParseBool(s)
+	default:
+		return s, nil
+	}
+}
+
+// parseAll converts each of values to type t. The result is a []string,
+// []int, []time.Duration or []bool.
+func (t ArgType) parseAll(values []string) (interface{}, error) {
+	var (
+		strs  []string
+		ints  []int
+		durs  []time.Duration
+		bools []bool
+	)
+	for _, value := range values {
+		v, err := t.parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid %s", value, t)
+		}
+
+		switch v := v.(type) {
+		case int:
+			ints = append(ints, v)
+		case time.Duration:
+			durs = append(durs, v)
+		case bool:
+			bools = append(bools, v)
+		case string:
+			strs = append(strs, v)
+		}
+	}
+
+	switch t {
+	case IntArg:
+		return ints, nil
+	case DurationArg:
+		return durs, nil
+	case BoolArg:
+		return bools, nil
+	default:
+		return strs, nil
+	}
+}
+
+// ArgError is an error in the arguments given to a command.
+type ArgError struct {
+	msg string
+}
+
+func (e *ArgError) Error() string {
+	return e.msg
+}
+
+func argErrorf(format string, a ...interface{}) error {
+	return &ArgError{msg: fmt.Sprintf(format, a...)}
+}
+
+// Args are the arguments a command was invoked with.
+type Args struct {
+	raw    []string
+	values map[string]interface{}
+}
+
+// NewArgs creates Args from raw arguments without a spec.
+func NewArgs(raw ...string) Args {
+	return Args{
+		raw:    raw,
+		values: make(map[string]interface{}),
+	}
+}
+
+// Raw returns the arguments as given, with quotes removed.
+func (a Args) Raw() []string {
+	return a.raw
+}
+
+// Has returns true if the argument or flag was given or has a default.
+func (a Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// String returns a string argument.
+func (a Args) String(name string) string {
+	switch v := a.values[name].(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, " ")
+	default:
+		return ""
+	}
+}
+
+// Strings returns the values of a variadic argument.
+func (a Args) Strings(name string) []string {
+	switch v := a.values[name].(type) {
+	case []string:
+		return v
+	case string:
+		return []string{v}
+	default:
+		return nil
+	}
+}
+
+// Int returns an int argument.
+func (a Args) Int(name string) int {
+	v, _ := a.values[name].(int)
+	return v
+}
+
+// Ints returns the values of a variadic int argument.
+func (a Args) Ints(name string) []int {
+	v, _ := a.values[name].([]int)
+	return v
+}
+
+// Duration returns a duration argument.
+func (a Args) Duration(name string) time.Duration {
+	v, _ := a.values[name].(time.Duration)
+	return v
+}
+
+// Durations returns the values of a variadic duration argument.
+func (a Args) Durations(name string) []time.Duration {
+	v, _ := a.values[name].([]time.Duration)
+	return v
+}
+
+// Bool returns a bool flag.
+func (a Args) Bool(name string) bool {
+	v, _ := a.values[name].(bool)
+	return v
+}
+
+// Parse validates raw arguments against the spec.
+func (s ArgSpec) Parse(raw []string) (Args, error) {
+	args := NewArgs(raw...)
+
+	flags := make(map[string]Flag)
+	for _, f := range s.Flags {
+		flags[f.Name] = f
+		if f.Default == "" {
+			continue
+		}
+		v, err := f.Type.parse(f.Default)
+		if err != nil {
+			return args, fmt.Errorf("invalid default for flag --%s: %v", f.Name, err)
+		}
+		args.values[f.Name] = v
+	}
+
+	var positional []string
+	for i := 0; i < len(raw); i++ {
+		token := raw[i]
+		if token == "--" {
+			positional = append(positional, raw[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(token, "--") || len(s.Flags) == 0 {
+			positional = append(positional, token)
+			continue
+		}
+
+		name := strings.TrimPrefix(token, "--")
+		value, hasValue := "", false
+		if idx := strings.Index(name, "="); idx != -1 {
+			name, value, hasValue = name[:idx], name[idx+1:], true
+		}
+
+		f, ok := flags[name]
+		if !ok {
+			return args, argErrorf("unknown flag --%s", name)
+		}
+
+		if !hasValue {
+			switch {
+			case f.Type == BoolArg:
+				value = "true"
+			case i+1 < len(raw):
+				i++
+				value = raw[i]
+			default:
+				return args, argErrorf("flag --%s requires a value", name)
+			}
+		}
+
+		v, err := f.Type.parse(value)
+		if err != nil {
+			return args, argErrorf("flag --%s: %q is not a valid %s", name, value, f.Type)
+		}
+		args.values[name] = v
+	}
+
+	for i, a := range s.Args {
+		if i >= len(positional) {
+			if !a.Optional {
+				return args, argErrorf("missing argument <%s>", a.Name)
+			}
+			break
+		}
+
+		if !a.Variadic {
+			v, err := a.Type.parse(positional[i])
+			if err != nil {
+				return args, argErrorf("argument <%s>: %q is not a valid %s", a.Name, positional[i], a.Type)
+			}
+			args.values[a.Name] = v
+			continue
+		}
+
+		v, err := a.Type.parseAll(positional[i:])
+		if err != nil {
+			return args, argErrorf("argument <%s>: %v", a.Name, err)
+		}
+		args.values[a.Name] = v
+	}
+
+	if n := len(s.Args); (n == 0 || !s.Args[n-1].Variadic) && len(positional) > n {
+		return args, argErrorf("too many arguments")
+	}
+
+	return args, nil
+}
+
+var errUnterminatedQuote = &ArgError{msg: "unterminated quote"}
+
+// splitArgs splits msg into whitespace separated tokens. Double quoted
+// text is kept together as one token, and a backslash escapes a quote or
+// backslash inside quotes.
+func splitArgs(msg string) ([]string, error) {
+	var (
+		tokens  []string
+		token   []rune
+		inToken bool
+		quoted  bool
+		escaped bool
+	)
+
+	for _, r := range msg {
+		switch {
+		case escaped:
+			token = append(token, r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inToken = true
+		case !quoted && unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, string(token))
+				token, inToken = nil, false
+			}
+		default:
+			token = append(token, r)
+			inToken = true
+		}
+	}
+
+	if quoted || escaped {
+		return nil, errUnterminatedQuote
+	}
+	if inToken {
+		tokens = append(tokens, string(token))
+	}
+
+	return tokens, nil
+}
+
+// isArgError returns true if err describes invalid command input.
+func isArgError(err error) bool {
+	_, ok := err.(*ArgError)
+	return ok || err == ErrUsage
+}
@@ -0,0 +1,293 @@
+package chatbot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", msg: "", want: nil},
+		{name: "words", msg: "weather  90210\tnow", want: []string{"weather", "90210", "now"}},
+		{name: "quoted", msg: `weather "San Francisco"`, want: []string{"weather", "San Francisco"}},
+		{name: "quote inside word", msg: `say x"a b"y`, want: []string{"say", "xa by"}},
+		{name: "empty quotes", msg: `say ""`, want: []string{"say", ""}},
+		{name: "escaped quote", msg: `say "a \"b\" \\c"`, want: []string{"say", `a "b" \c`}},
+		{name: "backslash outside quotes", msg: `say a\b`, want: []string{"say", `a\b`}},
+		{name: "unterminated quote", msg: `say "hello`, wantErr: true},
+		{name: "trailing escape", msg: `say "hello\`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitArgs(tt.msg)
+			if tt.wantErr {
+				if err != errUnterminatedQuote {
+					t.Errorf("splitArgs() error = %v, want %v", err, errUnterminatedQuote)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitArgs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgSpecParse(t *testing.T) {
+	spec := ArgSpec{
+		Args: []Arg{
+			{Name: "zip", Type: IntArg},
+			{Name: "when", Type: DurationArg, Optional: true},
+			{Name: "words", Optional: true, Variadic: true},
+		},
+		Flags: []Flag{
+			{Name: "units", Default: "metric"},
+			{Name: "days", Type: IntArg},
+			{Name: "verbose", Type: BoolArg},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		raw     []string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "required only",
+			raw:  []string{"90210"},
+			want: map[string]interface{}{"zip": 90210, "units": "metric"},
+		},
+		{
+			name: "optional",
+			raw:  []string{"90210", "1h30m"},
+			want: map[string]interface{}{"zip": 90210, "when": 90 * time.Minute, "units": "metric"},
+		},
+		{
+			name: "variadic",
+			raw:  []string{"90210", "1h", "a", "b c"},
+			want: map[string]interface{}{"zip": 90210, "when": time.Hour, "words": []string{"a", "b c"}, "units": "metric"},
+		},
+		{
+			name: "flags with equals",
+			raw:  []string{"--units=imperial", "--days=3", "--verbose", "90210"},
+			want: map[string]interface{}{"zip": 90210, "units": "imperial", "days": 3, "verbose": true},
+		},
+		{
+			name: "flag value in next argument",
+			raw:  []string{"--days", "3", "90210"},
+			want: map[string]interface{}{"zip": 90210, "units": "metric", "days": 3},
+		},
+		{
+			name: "bool flag with value",
+			raw:  []string{"--verbose=false", "90210"},
+			want: map[string]interface{}{"zip": 90210, "units": "metric", "verbose": false},
+		},
+		{
+			name: "double dash ends flags",
+			raw:  []string{"90210", "1h", "--", "--units=x"},
+			want: map[string]interface{}{"zip": 90210, "when": time.Hour, "words": []string{"--units=x"}, "units": "metric"},
+		},
+		{name: "missing required", raw: nil, wantErr: "missing argument <zip>"},
+		{name: "invalid int", raw: []string{"abc"}, wantErr: `argument <zip>: "abc" is not a valid int`},
+		{name: "invalid duration", raw: []string{"90210", "soon"}, wantErr: `argument <when>: "soon" is not a valid duration`},
+		{name: "unknown flag", raw: []string{"--color", "90210"}, wantErr: "unknown flag --color"},
+		{name: "flag without value", raw: []string{"90210", "--days"}, wantErr: "flag --days requires a value"},
+		{name: "invalid flag value", raw: []string{"--days=many", "90210"}, wantErr: `flag --days: "many" is not a valid int`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := spec.Parse(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				if !isArgError(err) {
+					t.Errorf("Parse() error %v is not an ArgError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(args.values, tt.want) {
+				t.Errorf("Parse() values = %#v, want %#v", args.values, tt.want)
+			}
+			if !reflect.DeepEqual(args.Raw(), tt.raw) {
+				t.Errorf("Raw() = %q, want %q", args.Raw(), tt.raw)
+			}
+		})
+	}
+}
+
+func TestArgSpecParseTooMany(t *testing.T) {
+	spec := ArgSpec{Args: []Arg{{Name: "zip"}}}
+	if _, err := spec.Parse([]string{"1", "2"}); err == nil || err.Error() != "too many arguments" {
+		t.Errorf("Parse() error = %v, want too many arguments", err)
+	}
+}
+
+func TestArgSpecParseTypedVariadic(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  ArgType
+		raw  []string
+		get  func(a Args) interface{}
+		want interface{}
+		err  string
+	}{
+		{
+			name: "ints",
+			typ:  IntArg,
+			raw:  []string{"1", "2", "3"},
+			get:  func(a Args) interface{} { return a.Ints("n") },
+			want: []int{1, 2, 3},
+		},
+		{
+			name: "durations",
+			typ:  DurationArg,
+			raw:  []string{"1s", "2m"},
+			get:  func(a Args) interface{} { return a.Durations("n") },
+			want: []time.Duration{time.Second, 2 * time.Minute},
+		},
+		{
+			name: "strings",
+			raw:  []string{"a", "b"},
+			get:  func(a Args) interface{} { return a.Strings("n") },
+			want: []string{"a", "b"},
+		},
+		{
+			name: "invalid int",
+			typ:  IntArg,
+			raw:  []string{"1", "two"},
+			err:  `argument <n>: "two" is not a valid int`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := ArgSpec{Args: []Arg{{Name: "n", Type: tt.typ, Variadic: true}}}
+			args, err := spec.Parse(tt.raw)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("Parse() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got := tt.get(args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgSpecUsage(t *testing.T) {
+	spec := ArgSpec{
+		Args: []Arg{
+			{Name: "zip", Type: IntArg},
+			{Name: "words", Optional: true, Variadic: true},
+		},
+		Flags: []Flag{
+			{Name: "units"},
+			{Name: "days", Type: IntArg},
+			{Name: "verbose", Type: BoolArg},
+		},
+	}
+
+	want := "[--units=<string>] [--days=<int>] [--verbose] <zip> [<words>...]"
+	if got := spec.Usage(); got != want {
+		t.Errorf("Usage() = %q, want %q", got, want)
+	}
+}
+
+func TestArgSpecValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec ArgSpec
+		err  string
+	}{
+		{
+			name: "valid",
+			spec: ArgSpec{
+				Args:  []Arg{{Name: "a"}, {Name: "b", Optional: true}, {Name: "c", Optional: true, Variadic: true}},
+				Flags: []Flag{{Name: "n", Type: IntArg, Default: "3"}},
+			},
+		},
+		{
+			name: "required after optional",
+			spec: ArgSpec{Args: []Arg{{Name: "a", Optional: true}, {Name: "b"}}},
+			err:  "required argument <b> follows an optional argument",
+		},
+		{
+			name: "variadic not last",
+			spec: ArgSpec{Args: []Arg{{Name: "a", Variadic: true}, {Name: "b"}}},
+			err:  "variadic argument <a> is not the last argument",
+		},
+		{
+			name: "duplicate argument",
+			spec: ArgSpec{Args: []Arg{{Name: "a"}, {Name: "a"}}},
+			err:  "argument <a> is declared twice",
+		},
+		{
+			name: "flag named like an argument",
+			spec: ArgSpec{Args: []Arg{{Name: "a"}}, Flags: []Flag{{Name: "a"}}},
+			err:  "flag --a is declared twice",
+		},
+		{
+			name: "invalid default",
+			spec: ArgSpec{Flags: []Flag{{Name: "n", Type: IntArg, Default: "many"}}},
+			err:  `invalid default for flag --n: strconv.Atoi: parsing "many": invalid syntax`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// specCommand is a command with a fixed ArgSpec.
+type specCommand struct {
+	spec ArgSpec
+}
+
+func (specCommand) Name() string                    { return "spec" }
+func (specCommand) Aliases() []string               { return nil }
+func (specCommand) Usage() string                   { return "" }
+func (specCommand) Handle(args Args) (State, error) { return nil, nil }
+func (c specCommand) ArgSpec() ArgSpec              { return c.spec }
+
+func TestRegistryRejectsInvalidArgSpec(t *testing.T) {
+	r := newRegistry()
+	cmd := specCommand{spec: ArgSpec{Args: []Arg{{Name: "a", Optional: true}, {Name: "b"}}}}
+	if err := r.Register(cmd); err == nil {
+		t.Fatal("Register() accepted an optional argument before a required one")
+	}
+	if _, ok := r.Lookup("spec"); ok {
+		t.Error("invalid command was registered")
+	}
+}
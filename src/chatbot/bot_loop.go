@@ -0,0 +1,146 @@
+package chatbot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultBotMessageLimit is how many times the bot may reply to
+	// another bot in a channel within defaultBotLoopWindow before the
+	// other bot is ignored.
+	defaultBotMessageLimit = 5
+	// defaultBotLoopWindow is the period replies are counted over, and
+	// how long a sender is ignored once the limit is exceeded.
+	defaultBotLoopWindow = 30 * time.Second
+)
+
+// botLoopKey identifies a sender in a channel on a gateway.
+type botLoopKey struct {
+	gateway Gateway
+	channel Destination
+	user    string
+}
+
+// newBotLoopKey returns the key for the sender of e's message.
+func newBotLoopKey(e Event) botLoopKey {
+	user := e.Message.UserID
+	if user == "" {
+		user = e.Message.UserName
+	}
+
+	return botLoopKey{gateway: e.Gateway, channel: e.Message.Channel, user: user}
+}
+
+// botLoops counts the bot's recent replies to other bots by sender and
+// channel.
+type botLoops struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	recent map[botLoopKey][]time.Time
+	muted  map[botLoopKey]time.Time
+}
+
+// newBotLoops creates an instance of botLoops.
+func newBotLoops(limit int, window time.Duration) *botLoops {
+	return &botLoops{
+		limit:  limit,
+		window: window,
+		recent: make(map[botLoopKey][]time.Time),
+		muted:  make(map[botLoopKey]time.Time),
+	}
+}
+
+// SetLimit sets how many replies are allowed within window. A limit of 0
+// never mutes a sender.
+func (b *botLoops) SetLimit(limit int, window time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limit = limit
+	b.window = window
+}
+
+// Muted returns true if messages from the sender are being ignored.
+func (b *botLoops) Muted(key botLoopKey, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.muted[key]
+	if !ok {
+		return false
+	}
+	if now.Before(until) {
+		return true
+	}
+
+	delete(b.muted, key)
+	return false
+}
+
+// Replied records a reply to the sender. The sender is muted once the
+// bot has replied to it more than limit times within window.
+func (b *botLoops) Replied(key botLoopKey, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit <= 0 {
+		return
+	}
+
+	var recent []time.Time
+	for _, t := range b.recent[key] {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) > b.limit {
+		delete(b.recent, key)
+		b.muted[key] = now.Add(b.window)
+		return
+	}
+
+	b.recent[key] = recent
+}
+
+// BreakBotLoops is a Middleware which stops the bot from talking back and
+// forth with other bots. Once the bot has replied to another bot more
+// than limit times within window, that bot's messages in the channel are
+// dropped for the next window. Messages from people are never dropped, so
+// loops are only broken on gateways which mark messages from bots.
+func BreakBotLoops(limit int, window time.Duration) Middleware {
+	return newBotLoops(limit, window).Middleware()
+}
+
+// Middleware returns a Middleware which breaks loops as BreakBotLoops
+// does, with the limit currently set.
+func (b *botLoops) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(e Event) {
+			if e.Type != MessageEvent || !e.Message.Bot {
+				next(e)
+				return
+			}
+
+			key := newBotLoopKey(e)
+			if b.Muted(key, time.Now()) {
+				logrus.WithFields(logrus.Fields{
+					"gateway": e.Gateway.Name(),
+					"channel": e.Message.Channel,
+					"user":    e.Message.UserName,
+				}).Warn("dropped message from a bot to break a loop")
+				return
+			}
+
+			e.onReply = func() {
+				b.Replied(key, time.Now())
+			}
+			next(e)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package chatbot
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingGateway is a Gateway which records what it is told.
+type recordingGateway struct {
+	mu   sync.Mutex
+	told []string
+}
+
+func (g *recordingGateway) Name() string                                { return "recording" }
+func (g *recordingGateway) Start(ctx context.Context) error             { return nil }
+func (g *recordingGateway) Display(dest Destination, r io.Reader) error { return nil }
+func (g *recordingGateway) Events() <-chan Event                        { return nil }
+func (g *recordingGateway) Tell(dest Destination, msg string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.told = append(g.told, msg)
+	return nil
+}
+
+// loopMessage returns a message event from user in channel.
+func loopMessage(gw Gateway, user, channel, text string, bot bool) Event {
+	return Event{
+		Type:    MessageEvent,
+		Gateway: gw,
+		Message: Message{Channel: Destination(channel), UserID: user, UserName: user, Text: text, Bot: bot},
+	}
+}
+
+// pingHandler counts the messages it handles and replies to pings.
+func pingHandler(handled *int) Handler {
+	return func(e Event) {
+		*handled++
+		if e.Message.Text == "ping" {
+			e.Reply("pong")
+		}
+	}
+}
+
+func TestBreakBotLoops(t *testing.T) {
+	gw := &recordingGateway{}
+	var handled int
+	h := chain(pingHandler(&handled), BreakBotLoops(2, time.Minute))
+
+	// Messages the bot doesn't reply to are never dropped.
+	for i := 0; i < 5; i++ {
+		h(loopMessage(gw, "otherbot", "#general", "chatter", true))
+	}
+	if handled != 5 {
+		t.Fatalf("handled %d unanswered messages, want 5", handled)
+	}
+
+	// The third reply to the same bot mutes it.
+	handled = 0
+	for i := 0; i < 5; i++ {
+		h(loopMessage(gw, "otherbot", "#general", "ping", true))
+	}
+	if handled != 3 {
+		t.Errorf("handled %d pings, want 3", handled)
+	}
+	if len(gw.told) != 3 {
+		t.Errorf("replied %d times, want 3", len(gw.told))
+	}
+
+	// Other bots, and the same bot elsewhere, are unaffected.
+	handled = 0
+	h(loopMessage(gw, "thirdbot", "#general", "ping", true))
+	h(loopMessage(gw, "otherbot", "#random", "ping", true))
+	if handled != 2 {
+		t.Errorf("handled %d messages from unmuted bots, want 2", handled)
+	}
+}
+
+func TestBreakBotLoopsIgnoresPeople(t *testing.T) {
+	gw := &recordingGateway{}
+	var handled int
+	h := chain(pingHandler(&handled), BreakBotLoops(2, time.Minute))
+
+	// A person running commands in quick succession is never muted.
+	for i := 0; i < 50; i++ {
+		h(loopMessage(gw, "person", "#general", "ping", false))
+	}
+	if handled != 50 {
+		t.Errorf("handled %d of 50 commands from a person", handled)
+	}
+	if len(gw.told) != 50 {
+		t.Errorf("replied %d times, want 50", len(gw.told))
+	}
+}
+
+func TestBotLoopsSetLimit(t *testing.T) {
+	gw := &recordingGateway{}
+	loops := newBotLoops(2, time.Minute)
+	var handled int
+	h := chain(pingHandler(&handled), loops.Middleware())
+
+	// A limit of 0 turns loop breaking off.
+	loops.SetLimit(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		h(loopMessage(gw, "otherbot", "#general", "ping", true))
+	}
+	if handled != 10 {
+		t.Errorf("handled %d of 10 pings with no limit", handled)
+	}
+
+	handled = 0
+	loops.SetLimit(4, time.Minute)
+	for i := 0; i < 10; i++ {
+		h(loopMessage(gw, "otherbot", "#general", "ping", true))
+	}
+	if handled != 5 {
+		t.Errorf("handled %d pings with a limit of 4, want 5", handled)
+	}
+}
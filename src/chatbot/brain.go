@@ -3,37 +3,80 @@ package chatbot
 import "strings"
 
 const (
-	botCommandPrefix = "!"
+	defaultCommandPrefix = "!"
 )
 
 // brain is the chatbot brain.
 type brain struct {
+	commands *registry
+	acl      *ACL
+	prefixes *prefixes
 }
 
 // newBrain creates a new instance of Brain.
 func newBrain() *brain {
-	return &brain{}
+	return &brain{
+		commands: newRegistry(),
+		acl:      NewACL(),
+		prefixes: newPrefixes(defaultCommandPrefix),
+	}
 }
 
 // Parse parses a potential bot command.
-func (b *brain) Parse(msg string) state {
-	if msg == "" {
-		return unknownState([]string{})
-	}
-	fields := strings.Fields(msg)
-	if isBotCommand(fields) {
-		command := strings.TrimPrefix(fields[0], botCommandPrefix)
-		switch command {
-		case "weather":
-			return weatherSate(fields)
-		default:
-			return unknownState(fields)
-		}
-	}
-
-	return nil
+func (b *brain) Parse(e Event) State {
+	line, ok := b.CommandLine(e)
+	if !ok {
+		return nil
+	}
+
+	cmd, args, ok := b.Lookup(line)
+	if !ok {
+		fields := strings.Fields(line)
+		return unknownState(fields, b.commands.Suggest(fields[0]))
+	}
+	if _, err := splitArgs(line); err != nil {
+		return usageState(cmd, err)
+	}
+
+	return commandState(b.acl, cmd, args)
 }
 
-func isBotCommand(fields []string) bool {
-	return strings.HasPrefix(fields[0], botCommandPrefix)
+// CommandLine returns the command in a message event without the prefix
+// or the bot's name, e.g. "weather 90210". Messages are commands if they
+// start with the prefix for their channel, are addressed to the bot, or
+// are sent directly to the bot.
+func (b *brain) CommandLine(e Event) (string, bool) {
+	text := strings.TrimSpace(e.Message.Text)
+	prefix := b.prefixes.For(e.Gateway.Name(), e.Message.Channel)
+
+	if rest, ok := addressed(e.Gateway, text); ok {
+		text = rest
+	} else if !e.Message.Direct && (prefix == "" || !strings.HasPrefix(text, prefix)) {
+		return "", false
+	}
+
+	text = strings.TrimSpace(strings.TrimPrefix(text, prefix))
+	return text, text != ""
+}
+
+// Lookup finds the registered command invoked by a command line and its
+// arguments. Quoted arguments are kept together.
+func (b *brain) Lookup(line string) (Command, []string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil, false
+	}
+
+	cmd, ok := b.commands.Lookup(fields[0])
+	if !ok {
+		return nil, nil, false
+	}
+
+	args, err := splitArgs(line)
+	if err != nil {
+		// Parse reports the unbalanced quote.
+		return cmd, fields[1:], true
+	}
+
+	return cmd, args[1:], true
 }
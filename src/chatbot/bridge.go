@@ -0,0 +1,208 @@
+package chatbot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// relayMemory is how long a relayed message is remembered so its echo
+	// isn't relayed back.
+	relayMemory = time.Minute
+)
+
+// BridgeEndpoint is a channel on a gateway which is part of a bridge.
+type BridgeEndpoint struct {
+	Gateway Gateway
+	Channel Destination
+}
+
+func (be BridgeEndpoint) matches(e Event) bool {
+	return be.Gateway == e.Gateway && be.Channel == e.Message.Channel
+}
+
+// BridgeFilter decides whether a message is relayed by a bridge.
+type BridgeFilter func(e Event) bool
+
+// SkipCommands is a BridgeFilter which doesn't relay bot commands.
+func SkipCommands(e Event) bool {
+	return !e.IsCommand()
+}
+
+// SkipUsers creates a BridgeFilter which doesn't relay messages from the
+// given user IDs.
+func SkipUsers(userIDs ...string) BridgeFilter {
+	skip := make(map[string]bool)
+	for _, id := range userIDs {
+		skip[id] = true
+	}
+
+	return func(e Event) bool {
+		return !skip[e.Message.UserID]
+	}
+}
+
+// Bridge relays messages sent to any of its endpoints to the others.
+type Bridge struct {
+	Endpoints []BridgeEndpoint
+	// Filters must all pass for a message to be relayed.
+	Filters []BridgeFilter
+}
+
+// ParseBridge creates a bridge from a space separated list of
+// gateway=channel endpoints, e.g. "irc=#twiki slack=C024BE91L".
+func ParseBridge(spec string, gateways ...Gateway) (Bridge, error) {
+	byName := make(map[string]Gateway)
+	for _, gw := range gateways {
+		byName[gw.Name()] = gw
+	}
+
+	var b Bridge
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return b, fmt.Errorf("invalid bridge endpoint %q", field)
+		}
+
+		gw, ok := byName[parts[0]]
+		if !ok {
+			return b, fmt.Errorf("unknown gateway %q in bridge endpoint %q", parts[0], field)
+		}
+
+		b.Endpoints = append(b.Endpoints, BridgeEndpoint{
+			Gateway: gw,
+			Channel: Destination(parts[1]),
+		})
+	}
+
+	if len(b.Endpoints) < 2 {
+		return b, fmt.Errorf("bridge %q needs at least two endpoints", spec)
+	}
+
+	return b, nil
+}
+
+// relayKey identifies a message relayed to an endpoint.
+type relayKey struct {
+	endpoint BridgeEndpoint
+	text     string
+}
+
+func newRelayKey(be BridgeEndpoint, text string) relayKey {
+	return relayKey{
+		endpoint: be,
+		text:     strings.TrimSpace(html.UnescapeString(text)),
+	}
+}
+
+// bridges relays messages for a set of bridges.
+type bridges struct {
+	mu      sync.Mutex
+	bridges []Bridge
+	relayed map[relayKey]time.Time
+	logger  *logrus.Entry
+}
+
+// newBridges creates an instance of bridges.
+func newBridges() *bridges {
+	return &bridges{
+		relayed: make(map[relayKey]time.Time),
+		logger:  logrus.WithField("chatbot", "bridge"),
+	}
+}
+
+// Add adds a bridge.
+func (b *bridges) Add(bridge Bridge) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bridges = append(b.bridges, bridge)
+}
+
+// Relay sends a message event to the other endpoints of every bridge its
+// channel is part of. Messages without text aren't relayed.
+func (b *bridges) Relay(e Event) {
+	if strings.TrimSpace(e.Message.Text) == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for key, at := range b.relayed {
+		if now.Sub(at) > relayMemory {
+			delete(b.relayed, key)
+		}
+	}
+
+	for _, bridge := range b.bridges {
+		origin, ok := bridge.endpoint(e)
+		if !ok {
+			continue
+		}
+
+		// The message is the echo of one this bridge relayed.
+		if key := newRelayKey(origin, e.Message.Text); !b.relayed[key].IsZero() {
+			delete(b.relayed, key)
+			continue
+		}
+
+		if !bridge.allows(e) {
+			continue
+		}
+
+		msg := attribute(e)
+		for _, be := range bridge.Endpoints {
+			if be == origin {
+				continue
+			}
+
+			b.relayed[newRelayKey(be, msg)] = now
+			if err := be.Gateway.Tell(be.Channel, msg); err != nil {
+				b.logger.WithError(err).WithFields(logrus.Fields{
+					"gateway": be.Gateway.Name(),
+					"channel": be.Channel,
+				}).Error("unable to relay message")
+			}
+		}
+	}
+}
+
+// endpoint returns the bridge's endpoint the event was sent to.
+func (b Bridge) endpoint(e Event) (BridgeEndpoint, bool) {
+	for _, be := range b.Endpoints {
+		if be.matches(e) {
+			return be, true
+		}
+	}
+
+	return BridgeEndpoint{}, false
+}
+
+// allows returns true if every filter allows the event.
+func (b Bridge) allows(e Event) bool {
+	for _, filter := range b.Filters {
+		if !filter(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// attribute prefixes a message with its sender, e.g. "<alice@irc> hi".
+func attribute(e Event) string {
+	sender := e.Message.UserName
+	if sender == "" {
+		sender = e.Message.UserID
+	}
+
+	return fmt.Sprintf("<%s@%s> %s", sender, e.Gateway.Name(),
+		strings.TrimSpace(e.Message.Text))
+}
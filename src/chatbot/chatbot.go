@@ -3,20 +3,126 @@
 package chatbot
 
 import (
+	"context"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// eventBufferSize is how many events can be waiting to be handled.
+	eventBufferSize = 10
+	// defaultShutdownTimeout is how long Run waits for events to be
+	// handled and gateways to stop when shutting down.
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 // Destination is where a message will be displayed.
 type Destination string
 
+// Message is the context of a chat message received by a gateway.
+type Message struct {
+	// Channel is where the message was sent. Replies to the message
+	// should be sent here.
+	Channel Destination
+	// ChannelName is the channel's display name, if the gateway
+	// identifies channels by ID.
+	ChannelName string
+	// UserID is the gateway's identifier for the sender.
+	UserID string
+	// UserName is the sender's display name.
+	UserName string
+	// ThreadID identifies the thread or parent message the message
+	// belongs to, if the gateway supports threads.
+	ThreadID string
+	// Timestamp is when the message was sent.
+	Timestamp time.Time
+	// Direct is true if the message was sent directly to the bot.
+	Direct bool
+	// Bot is true if the message was sent by another bot.
+	Bot bool
+	// Text is the message text. For an ActionEvent it is the name of
+	// the clicked action.
+	Text string
+	// CallbackID identifies the buttons an ActionEvent's click belongs
+	// to.
+	CallbackID string
+	// Raw is the gateway specific data the message was created from.
+	Raw interface{}
+}
+
 // Event is a bot event.
 type Event struct {
 	Type    EventType
 	Gateway Gateway
-	Creator string
-	Payload interface{}
+	Message Message
+
+	conversations *conversations
+	offers        *offers
+	brain         *brain
+	// onReply, if set, is called whenever the bot replies to the event.
+	onReply func()
+}
+
+// Reply sends msg to where the event's message was sent. If the message
+// was sent in a thread, the reply is sent to the thread.
+func (e Event) Reply(msg string) error {
+	return e.reply(msg, false)
+}
+
+// ReplyBroadcast is like Reply, but a reply to a thread is also shown in
+// the thread's channel.
+func (e Event) ReplyBroadcast(msg string) error {
+	return e.reply(msg, true)
+}
+
+func (e Event) reply(msg string, broadcast bool) error {
+	e.replied()
+
+	if mr, ok := e.Gateway.(MessageReplier); ok {
+		return mr.ReplyTo(e.Message, msg, broadcast)
+	}
+	if tt, ok := e.Gateway.(ThreadTeller); ok && e.Message.ThreadID != "" {
+		return tt.TellThread(e.Message.Channel, e.Message.ThreadID, msg, broadcast)
+	}
+
+	return e.Gateway.Tell(e.Message.Channel, msg)
+}
+
+// replied notes that the bot replied to the event.
+func (e Event) replied() {
+	if e.onReply != nil {
+		e.onReply()
+	}
+}
+
+// Prefix returns the command prefix for the channel the event's message
+// was sent to.
+func (e Event) Prefix() string {
+	if e.brain == nil {
+		return defaultCommandPrefix
+	}
+
+	return e.brain.prefixes.For(e.Gateway.Name(), e.Message.Channel)
+}
+
+// IsCommand returns true if the event's message is a bot command.
+func (e Event) IsCommand() bool {
+	if e.brain == nil {
+		return false
+	}
+
+	_, ok := e.brain.CommandLine(e)
+	return ok
+}
+
+// Formatter returns the formatter for the event's gateway.
+func (e Event) Formatter() Formatter {
+	return formatterFor(e.Gateway)
 }
 
 // EventType is an event type.
@@ -27,69 +133,333 @@ const (
 	AddEvent EventType = iota
 	// MessageEvent denotes a client has sent a message.
 	MessageEvent
+	// ActionEvent denotes a client has clicked a button offered with a
+	// reply.
+	ActionEvent
+	// RemoveEvent denotes that a client has left.
+	RemoveEvent
 )
 
 // Gateway is a Chatbot's interface to the world.
 type Gateway interface {
-	Start(errChan chan error)
-	Stop()
+	Name() string
+	// Start runs the gateway until ctx is cancelled or it fails.
+	Start(ctx context.Context) error
 	Tell(dest Destination, msg string) error
 	Display(dest Destination, imageData io.Reader) error
 	Events() <-chan Event
 }
 
+// Image is image data with a title and comment, which gateways show with
+// the image where they can. It may be passed to a gateway's Display.
+type Image struct {
+	io.Reader
+	Title   string
+	Comment string
+}
+
+// imageCaption returns the title and comment of imageData if it is an
+// Image.
+func imageCaption(imageData io.Reader) (title, comment string) {
+	if img, ok := imageData.(Image); ok {
+		return img.Title, img.Comment
+	}
+	if img, ok := imageData.(*Image); ok {
+		return img.Title, img.Comment
+	}
+	return "", ""
+}
+
 // Chatbot is a chatbot.
 type Chatbot struct {
-	gateways  []Gateway
-	brain     *brain
-	eventChan chan Event
-	logger    *logrus.Entry
+	gateways        []Gateway
+	brain           *brain
+	conversations   *conversations
+	offers          *offers
+	bridges         *bridges
+	middlewares     []Middleware
+	images          *ImageServer
+	botLoops        *botLoops
+	shutdownTimeout time.Duration
+	logger          *logrus.Entry
 }
 
-// New creates an instance of Chatbot.
+// New creates an instance of Chatbot with the built-in commands
+// registered.
 func New(gateways ...Gateway) *Chatbot {
-	return &Chatbot{
-		brain:    newBrain(),
-		gateways: gateways,
-		logger:   logrus.WithField("chatbot", "main"),
+	c := &Chatbot{
+		brain:           newBrain(),
+		conversations:   newConversations(defaultConversationTimeout),
+		offers:          newOffers(defaultActionTimeout),
+		bridges:         newBridges(),
+		gateways:        gateways,
+		botLoops:        newBotLoops(defaultBotMessageLimit, defaultBotLoopWindow),
+		shutdownTimeout: defaultShutdownTimeout,
+		logger:          logrus.WithField("chatbot", "main"),
 	}
+	c.Use(LogEvents(c.logger), c.botLoops.Middleware())
+
+	builtins := []Command{
+		helpCommand{commands: c.brain.commands},
+		weatherCommand{},
+		cancelCommand{},
+		grantCommand{acl: c.brain.acl},
+		revokeCommand{acl: c.brain.acl},
+		joinCommand{},
+		partCommand{},
+		statusCommand{gateways: gateways},
+	}
+	if err := c.Register(builtins...); err != nil {
+		panic(err)
+	}
+
+	return c
 }
 
-// Start starts the chatbot.
-func (c *Chatbot) Start(errChan chan error) {
-	c.eventChan = make(chan Event, 10)
+// Register adds commands to the chatbot. It returns an error if a
+// command's name or alias is already registered.
+func (c *Chatbot) Register(cmds ...Command) error {
+	for _, cmd := range cmds {
+		if err := c.brain.commands.Register(cmd); err != nil {
+			return err
+		}
+	}
 
-	go func() {
-		for event := range c.eventChan {
-			c.logger.WithField("event", event).Info("received event")
+	return nil
+}
 
-			switch event.Type {
-			case MessageEvent:
-				s := c.brain.Parse(event.Payload.(string))
+// ACL returns the access control list which decides who may run each
+// command.
+func (c *Chatbot) ACL() *ACL {
+	return c.brain.acl
+}
 
-				for s != nil {
-					s = s(event)
-				}
-			}
+// SetShutdownTimeout sets how long Run waits for events to be handled and
+// gateways to stop when shutting down.
+func (c *Chatbot) SetShutdownTimeout(timeout time.Duration) {
+	c.shutdownTimeout = timeout
+}
+
+// SetPrefix sets the prefix which marks messages as bot commands. It
+// applies to channel on the named gateway, to every channel on the gateway
+// if channel is empty, or is the default if gateway is empty. An empty
+// prefix means only messages addressed to the bot are commands.
+func (c *Chatbot) SetPrefix(gateway string, channel Destination, prefix string) {
+	c.brain.prefixes.Set(gateway, channel, prefix)
+}
+
+// SetConversationTimeout sets how long a conversation waits for a user's
+// next message before it is abandoned.
+func (c *Chatbot) SetConversationTimeout(timeout time.Duration) {
+	c.conversations.SetTimeout(timeout)
+}
+
+// SetBotLoopLimit sets how many times the bot may reply to another bot in
+// a channel within window before ignoring it for the next window. A limit
+// of 0 turns loop breaking off.
+func (c *Chatbot) SetBotLoopLimit(limit int, window time.Duration) {
+	c.botLoops.SetLimit(limit, window)
+}
+
+// AddBridge relays messages between the bridge's endpoints.
+func (c *Chatbot) AddBridge(b Bridge) {
+	c.bridges.Add(b)
+}
+
+// SetImageServer hosts the images displayed on gateways which can't upload
+// them, and runs the server along with the gateways. It must be called
+// before Run.
+func (c *Chatbot) SetImageServer(s *ImageServer) {
+	c.images = s
+	for _, gw := range c.gateways {
+		if h, ok := gw.(ImageHosted); ok {
+			h.SetImageHost(s)
 		}
-	}()
+	}
+}
+
+// Use adds middlewares which run around the handling of every event.
+// Middlewares run in the order they were added. Use must be called before
+// Run.
+func (c *Chatbot) Use(middlewares ...Middleware) {
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// Run starts the gateways and handles their events until ctx is
+// cancelled or a gateway fails. It then stops accepting events, waits for
+// events already received to be handled, and stops the gateways, taking
+// no longer than the shutdown timeout in all. The errors of gateways which
+// failed are returned combined.
+func (c *Chatbot) Run(ctx context.Context) error {
+	runCtx, stopRunning := context.WithCancel(ctx)
+	defer stopRunning()
+	gwCtx, stopGateways := context.WithCancel(context.Background())
+	defer stopGateways()
+
+	events := make(chan Event, eventBufferSize)
+	// errs has room for an error from every gateway and the image server,
+	// so a failure is never blocked on, even after Run returns.
+	errs := make(chan error, len(c.gateways)+1)
+	fail := func(err error) {
+		errs <- err
+		stopRunning()
+	}
+
+	var gwWG, forwardWG sync.WaitGroup
+	if c.images != nil {
+		gwWG.Add(1)
+		go func() {
+			defer gwWG.Done()
+			if err := c.images.Start(gwCtx); err != nil {
+				c.logger.WithError(err).Error("image server failure")
+				fail(errors.Wrap(err, "image server"))
+			}
+		}()
+	}
 
 	for _, gw := range c.gateways {
-		go gw.Start(errChan)
-		go func(currentGw Gateway) {
-			for event := range currentGw.Events() {
-				c.eventChan <- event
+		gwWG.Add(1)
+		go func(gw Gateway) {
+			defer gwWG.Done()
+			if err := gw.Start(gwCtx); err != nil {
+				c.logger.WithError(err).WithField("gateway", gw.Name()).Error("gateway failure")
+				fail(errors.Wrapf(err, "%s gateway", gw.Name()))
 			}
 		}(gw)
 
+		forwardWG.Add(1)
+		go func(gw Gateway) {
+			defer forwardWG.Done()
+			c.forward(runCtx, gw, events)
+		}(gw)
+	}
+
+	handler := chain(c.handle, c.middlewares...)
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for event := range events {
+			event.conversations = c.conversations
+			event.offers = c.offers
+			event.brain = c.brain
+			handler(event)
+		}
+	}()
+
+	<-runCtx.Done()
+	c.logger.Info("shutting down")
+
+	// Nothing sends on events once the forwarders have returned.
+	forwardWG.Wait()
+	close(events)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+
+	var errList multiError
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		errList = append(errList, errors.New("timed out handling remaining events"))
+	}
+
+	stopGateways()
+	stopped := make(chan struct{})
+	go func() {
+		gwWG.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		errList = append(errList, errors.New("timed out stopping gateways"))
 	}
+
+	// Gateways which haven't stopped may still fail, so errs is left open
+	// and only the errors already sent are collected.
+	for collected := false; !collected; {
+		select {
+		case err := <-errs:
+			errList = append(errList, err)
+		default:
+			collected = true
+		}
+	}
+
+	if len(errList) == 0 {
+		return nil
+	}
+	return errList
 }
 
-// Stop stops the chatbot.
-func (c *Chatbot) Stop() {
-	for _, gw := range c.gateways {
-		gw.Stop()
+// forward sends events from a gateway to events until ctx is done.
+func (c *Chatbot) forward(ctx context.Context, gw Gateway, events chan<- Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-gw.Events():
+			if !ok {
+				return
+			}
+			if !sendEvent(ctx, events, event) {
+				return
+			}
+		}
+	}
+}
+
+// handle relays an event across bridges and runs the brain on it,
+// handles a button click, or passes a user joining or leaving to the
+// commands which handle presence.
+func (c *Chatbot) handle(e Event) {
+	switch e.Type {
+	case MessageEvent:
+		c.bridges.Relay(e)
+
+		c.run(e, c.next(e))
+	case ActionEvent:
+		c.run(e, actionState(c.offers, c.brain.acl))
+	case AddEvent, RemoveEvent:
+		for _, cmd := range c.brain.commands.Commands() {
+			if ph, ok := cmd.(PresenceHandler); ok {
+				c.run(e, ph.HandlePresence(e))
+			}
+		}
+	}
+}
+
+// run runs states until one returns nil.
+func (c *Chatbot) run(e Event, s State) {
+	for s != nil {
+		s = s(e)
+	}
+}
+
+// next returns the state which handles a message event. A message
+// continues the sender's conversation, if one is parked, unless it cancels
+// it.
+func (c *Chatbot) next(e Event) State {
+	line, _ := c.brain.CommandLine(e)
+	cmd, _, _ := c.brain.Lookup(line)
+	if _, ok := cmd.(cancelCommand); !ok {
+		if s, ok := c.conversations.Resume(e); ok {
+			return s
+		}
+	}
+
+	return c.brain.Parse(e)
+}
+
+// multiError is a list of errors.
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
 	}
 
-	close(c.eventChan)
+	return strings.Join(msgs, "; ")
 }
@@ -0,0 +1,134 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// greetCommand greets users who join and says goodbye to those who leave.
+type greetCommand struct{}
+
+func (greetCommand) Name() string                    { return "greet" }
+func (greetCommand) Aliases() []string               { return nil }
+func (greetCommand) Usage() string                   { return "" }
+func (greetCommand) Handle(args Args) (State, error) { return nil, nil }
+
+func (greetCommand) HandlePresence(e Event) State {
+	return func(e Event) State {
+		if e.Type == AddEvent {
+			e.Reply("hello " + e.Message.UserName)
+		} else {
+			e.Reply("goodbye " + e.Message.UserName)
+		}
+		return nil
+	}
+}
+
+func TestChatbotHandlePresence(t *testing.T) {
+	c := New()
+	if err := c.Register(greetCommand{}); err != nil {
+		t.Fatal(err)
+	}
+
+	gw := &recordingGateway{}
+	for _, typ := range []EventType{AddEvent, MessageEvent, RemoveEvent} {
+		c.handle(Event{
+			Type:    typ,
+			Gateway: gw,
+			Message: Message{Channel: "#lobby", UserID: "bob", UserName: "bob", Text: "just chatting"},
+			brain:   c.brain,
+		})
+	}
+
+	want := []string{"hello bob", "goodbye bob"}
+	if !reflect.DeepEqual(gw.told, want) {
+		t.Errorf("told %q, want %q", gw.told, want)
+	}
+}
+
+// lifecycleGateway is a Gateway whose Start runs start.
+type lifecycleGateway struct {
+	start func(ctx context.Context) error
+}
+
+func (g *lifecycleGateway) Name() string                                { return "lifecycle" }
+func (g *lifecycleGateway) Start(ctx context.Context) error             { return g.start(ctx) }
+func (g *lifecycleGateway) Tell(dest Destination, msg string) error     { return nil }
+func (g *lifecycleGateway) Display(dest Destination, r io.Reader) error { return nil }
+func (g *lifecycleGateway) Events() <-chan Event                        { return nil }
+
+// runChatbot runs c until ctx is cancelled and returns Run's error, or
+// fails the test if Run doesn't return in time.
+func runChatbot(ctx context.Context, t *testing.T, c *Chatbot) error {
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't return")
+		return nil
+	}
+}
+
+func TestChatbotRunStops(t *testing.T) {
+	c := New(&lifecycleGateway{start: func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runChatbot(ctx, t, c); err != nil {
+		t.Errorf("Run() = %v", err)
+	}
+}
+
+func TestChatbotRunGatewayIgnoresCancellation(t *testing.T) {
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	c := New(&lifecycleGateway{start: func(ctx context.Context) error {
+		defer close(returned)
+		<-release
+		return errors.New("stopped late")
+	}})
+	c.SetShutdownTimeout(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := runChatbot(ctx, t, c)
+	if err == nil || !strings.Contains(err.Error(), "timed out stopping gateways") {
+		t.Errorf("Run() = %v, want a timeout stopping gateways", err)
+	}
+
+	// The gateway failing after Run has returned must not panic.
+	close(release)
+	<-returned
+}
+
+func TestChatbotRunGatewayFailsToStart(t *testing.T) {
+	started := make(chan struct{})
+	c := New(
+		&lifecycleGateway{start: func(ctx context.Context) error {
+			return errors.New("bad credentials")
+		}},
+		&lifecycleGateway{start: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return nil
+		}},
+	)
+
+	// Run stops without being cancelled when a gateway fails.
+	err := runChatbot(context.Background(), t, c)
+	if err == nil || err.Error() != "lifecycle gateway: bad credentials" {
+		t.Errorf("Run() = %v, want the gateway's error", err)
+	}
+	<-started
+}
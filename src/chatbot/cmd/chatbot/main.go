@@ -2,8 +2,11 @@ package main
 
 import (
 	"chatbot"
+	"context"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
@@ -12,9 +15,71 @@ import (
 type specification struct {
 	WeatherAPIKey string `envconfig:"weather_api_key" required:"true"`
 	BotName       string `envconfig:"bot_name" default:"TwikiTheBot"`
-	IRCChan       string `envconfig:"irc_chan" required:"true"`
-	SlackChan     string `envconfig:"slack_chan" required:"true"`
-	SlackToken    string `envconfig:"slack_token" required:"true"`
+	// IRCChans are the channels to join, given as "#name" or
+	// "#name:key".
+	IRCChans []string `envconfig:"irc_chan" required:"true"`
+
+	IRCServer           string `envconfig:"irc_server" default:"irc.freenode.net"`
+	IRCPort             int    `envconfig:"irc_port" default:"7000"`
+	IRCPassword         string `envconfig:"irc_password"`
+	IRCTLS              bool   `envconfig:"irc_tls" default:"true"`
+	IRCCAFile           string `envconfig:"irc_ca_file"`
+	IRCCertFile         string `envconfig:"irc_cert_file"`
+	IRCKeyFile          string `envconfig:"irc_key_file"`
+	IRCSASLMechanism    string `envconfig:"irc_sasl_mechanism"`
+	IRCSASLUser         string `envconfig:"irc_sasl_user"`
+	IRCSASLPassword     string `envconfig:"irc_sasl_password"`
+	IRCNickServPassword string `envconfig:"irc_nickserv_password"`
+
+	// LocalAddr is where the local chat gateway listens for clients.
+	LocalAddr           string        `envconfig:"local_addr" default:":8889"`
+	LocalMaxLineLength  int           `envconfig:"local_max_line_length" default:"4096"`
+	LocalIdleTimeout    time.Duration `envconfig:"local_idle_timeout" default:"30m"`
+	LocalMaxConnections int           `envconfig:"local_max_connections" default:"100"`
+	// LocalHTTPAddr serves a web client for the local chat if it is set.
+	LocalHTTPAddr string `envconfig:"local_http_addr"`
+
+	SlackChan  string `envconfig:"slack_chan" required:"true"`
+	SlackToken string `envconfig:"slack_token" required:"true"`
+	// SlackHTTPAddr receives slash commands and button clicks over HTTP
+	// if it is set, which needs SlackSigningSecret. SlackEventsAPI
+	// receives events over HTTP too, instead of the RTM websocket.
+	SlackHTTPAddr      string `envconfig:"slack_http_addr"`
+	SlackSigningSecret string `envconfig:"slack_signing_secret"`
+	SlackEventsAPI     bool   `envconfig:"slack_events_api"`
+
+	// Prefix marks messages as bot commands. Prefixes are
+	// gateway=prefix or gateway:channel=prefix overrides, e.g. "irc=@".
+	Prefix   string   `envconfig:"prefix" default:"!"`
+	Prefixes []string `envconfig:"prefixes"`
+
+	ConversationTimeout time.Duration `envconfig:"conversation_timeout" default:"5m"`
+	ShutdownTimeout     time.Duration `envconfig:"shutdown_timeout" default:"10s"`
+	// BotLoopLimit is how many times the bot replies to another bot in a
+	// channel within BotLoopWindow before ignoring it. 0 turns it off.
+	BotLoopLimit  int           `envconfig:"bot_loop_limit" default:"5"`
+	BotLoopWindow time.Duration `envconfig:"bot_loop_window" default:"30s"`
+	// Bridges are space separated gateway=channel lists, e.g.
+	// "irc=#twiki slack=C024BE91L".
+	Bridges []string `envconfig:"bridges"`
+	// BridgeCommands relays bot commands across bridges.
+	BridgeCommands bool `envconfig:"bridge_commands" default:"false"`
+
+	// ImageAddr is where the image server listens. ImageURL is the
+	// address chat users reach it at. ImageMaxBytes is how much image
+	// data is kept in memory.
+	ImageAddr     string        `envconfig:"image_addr" default:":8890"`
+	ImageURL      string        `envconfig:"image_url" default:"http://localhost:8890"`
+	ImageTTL      time.Duration `envconfig:"image_ttl" default:"1h"`
+	ImageMaxBytes int           `envconfig:"image_max_bytes" default:"268435456"`
+
+	// Admins, Operators and Banned are gateway:user identities, which may
+	// contain * wildcards, e.g. "slack:U024BE7LH" or "irc:bryanl!*@*".
+	// Local chat identities are nicknames anyone can take once they are
+	// free, so admins and operators can't be granted on the local gateway.
+	Admins    []string `envconfig:"admins"`
+	Operators []string `envconfig:"operators"`
+	Banned    []string `envconfig:"banned"`
 }
 
 func main() {
@@ -26,44 +91,146 @@ func main() {
 
 	chatbot.WeatherAPIKey = s.WeatherAPIKey
 
-	errChan := make(chan error)
-
-	go func() {
-		for err := range errChan {
-			logrus.WithError(err).Error("chatbot failure")
-		}
-	}()
-
-	localGw := initLocalGW(&s, errChan)
-	ircGw := initIRCGW(&s, errChan)
-	slackGw := initSlackGW(&s, errChan)
+	localGw := initLocalGW(&s)
+	ircGw := initIRCGW(&s)
+	slackGw := initSlackGW(&s)
 
 	cb := chatbot.New(localGw, ircGw, slackGw)
-	go cb.Start(errChan)
+	cb.SetConversationTimeout(s.ConversationTimeout)
+	cb.SetShutdownTimeout(s.ShutdownTimeout)
+	cb.SetBotLoopLimit(s.BotLoopLimit, s.BotLoopWindow)
+	images := chatbot.NewImageServer(s.ImageAddr, s.ImageURL, s.ImageTTL)
+	images.SetMaxBytes(s.ImageMaxBytes)
+	cb.SetImageServer(images)
+	initPrefixes(&s, cb)
+	initACL(&s, cb.ACL())
+
+	for _, spec := range s.Bridges {
+		b, err := chatbot.ParseBridge(spec, localGw, ircGw, slackGw)
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to parse bridge")
+		}
+		if !s.BridgeCommands {
+			b.Filters = append(b.Filters, chatbot.SkipCommands)
+		}
+		cb.AddBridge(b)
+	}
 
-	done := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
-		cb.Stop()
-
-		done <- true
+		cancel()
 	}()
 
 	logrus.Info("bot booted")
-	<-done
+	if err := cb.Run(ctx); err != nil {
+		logrus.WithError(err).Fatal("chatbot failure")
+	}
 }
 
-func initLocalGW(s *specification, errChan chan error) chatbot.Gateway {
-	return chatbot.NewLocalGateway(s.BotName)
+func initPrefixes(s *specification, cb *chatbot.Chatbot) {
+	cb.SetPrefix("", "", s.Prefix)
+
+	for _, override := range s.Prefixes {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			logrus.WithField("prefix", override).Fatal("invalid prefix override")
+		}
+
+		scope := strings.SplitN(parts[0], ":", 2)
+		var channel chatbot.Destination
+		if len(scope) == 2 {
+			channel = chatbot.Destination(scope[1])
+		}
+		cb.SetPrefix(scope[0], channel, parts[1])
+	}
 }
 
-func initIRCGW(s *specification, errChan chan error) chatbot.Gateway {
-	return chatbot.NewIRCGateway(s.BotName, s.IRCChan)
+func initACL(s *specification, acl *chatbot.ACL) {
+	grants := map[chatbot.Role][]string{
+		chatbot.RoleAdmin:    s.Admins,
+		chatbot.RoleOperator: s.Operators,
+		chatbot.RoleBanned:   s.Banned,
+	}
+
+	for role, identities := range grants {
+		for _, identity := range identities {
+			if role > chatbot.RoleUser && matchesLocal(identity) {
+				logrus.WithFields(logrus.Fields{
+					"identity": identity,
+					"role":     role,
+				}).Warn("ignoring grant for local chat users, who choose their own nicknames")
+				continue
+			}
+			acl.Grant(identity, role)
+		}
+	}
+}
+
+// matchesLocal returns true if an identity pattern can match users of the
+// local chat gateway.
+func matchesLocal(identity string) bool {
+	gateway := strings.SplitN(identity, ":", 2)[0]
+	return gateway == "local" || strings.Contains(gateway, "*")
+}
+
+func initLocalGW(s *specification) chatbot.Gateway {
+	return chatbot.NewLocalGateway(chatbot.LocalConfig{
+		BotName:        s.BotName,
+		Addr:           s.LocalAddr,
+		MaxLineLength:  s.LocalMaxLineLength,
+		IdleTimeout:    s.LocalIdleTimeout,
+		MaxConnections: s.LocalMaxConnections,
+		HTTPAddr:       s.LocalHTTPAddr,
+	})
+}
+
+func initIRCGW(s *specification) chatbot.Gateway {
+	var channels []chatbot.IRCChannel
+	for _, ch := range s.IRCChans {
+		channels = append(channels, chatbot.ParseIRCChannel(ch))
+	}
+
+	return chatbot.NewIRCGateway(chatbot.IRCConfig{
+		BotName:          s.BotName,
+		Channels:         channels,
+		Server:           s.IRCServer,
+		Port:             s.IRCPort,
+		Password:         s.IRCPassword,
+		TLS:              s.IRCTLS,
+		CAFile:           s.IRCCAFile,
+		CertFile:         s.IRCCertFile,
+		KeyFile:          s.IRCKeyFile,
+		SASLMechanism:    s.IRCSASLMechanism,
+		SASLUser:         s.IRCSASLUser,
+		SASLPassword:     s.IRCSASLPassword,
+		NickServPassword: s.IRCNickServPassword,
+	})
 }
 
-func initSlackGW(s *specification, errChan chan error) chatbot.Gateway {
-	return chatbot.NewSlackGateway(s.SlackToken, s.BotName, s.SlackChan)
+func initSlackGW(s *specification) chatbot.Gateway {
+	gw := chatbot.NewSlackGateway(s.SlackToken, s.BotName, s.SlackChan)
+	if s.SlackHTTPAddr == "" {
+		if s.SlackEventsAPI {
+			logrus.Fatal("slack http address is required to receive events over http")
+		}
+		if s.SlackSigningSecret != "" {
+			logrus.Warn("slack signing secret is set without an http address, slash commands and buttons won't be received")
+		}
+		return gw
+	}
+
+	if s.SlackSigningSecret == "" {
+		logrus.Fatal("slack signing secret is required to receive requests over http")
+	}
+	gw.ReceiveHTTP(chatbot.SlackHTTPConfig{
+		Addr:          s.SlackHTTPAddr,
+		SigningSecret: s.SlackSigningSecret,
+		Events:        s.SlackEventsAPI,
+	})
+
+	return gw
 }
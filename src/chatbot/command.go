@@ -0,0 +1,118 @@
+package chatbot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUsage is returned by a Command's Handle when it was invoked with
+// invalid arguments. The brain replies with the command's usage.
+var ErrUsage = errors.New("invalid usage")
+
+// Command is a bot command.
+type Command interface {
+	// Name is the name the command is invoked by.
+	Name() string
+	// Aliases are alternate names for the command.
+	Aliases() []string
+	// Usage describes the command's arguments, e.g. "<zip>". Commands
+	// implementing ArgSpecifier may return "" to have it generated.
+	Usage() string
+	// Handle creates the state which handles an invocation of the
+	// command with args.
+	Handle(args Args) (State, error)
+}
+
+// PresenceHandler is implemented by commands which react to users
+// joining and leaving channels.
+type PresenceHandler interface {
+	// HandlePresence creates the state which handles an AddEvent or
+	// RemoveEvent. It returns nil to ignore the event.
+	HandlePresence(e Event) State
+}
+
+// registry is a set of commands indexed by name and alias.
+type registry struct {
+	commands map[string]Command
+}
+
+// newRegistry creates an instance of registry.
+func newRegistry() *registry {
+	return &registry{
+		commands: make(map[string]Command),
+	}
+}
+
+// Register adds cmd to the registry. It is an error to register a name
+// or alias which is already taken, or a command with an invalid ArgSpec.
+func (r *registry) Register(cmd Command) error {
+	names := append([]string{cmd.Name()}, cmd.Aliases()...)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("invalid command name %q", name)
+		}
+		if _, ok := r.commands[name]; ok {
+			return fmt.Errorf("command %q is already registered", name)
+		}
+	}
+
+	if as, ok := cmd.(ArgSpecifier); ok {
+		if err := as.ArgSpec().validate(); err != nil {
+			return fmt.Errorf("command %q: %v", cmd.Name(), err)
+		}
+	}
+
+	for _, name := range names {
+		r.commands[name] = cmd
+	}
+
+	return nil
+}
+
+// Lookup finds a command by name or alias.
+func (r *registry) Lookup(name string) (Command, bool) {
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Commands returns the registered commands sorted by name.
+func (r *registry) Commands() []Command {
+	var cmds []Command
+	for name, cmd := range r.commands {
+		if name == cmd.Name() {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name() < cmds[j].Name()
+	})
+
+	return cmds
+}
+
+// usage returns the full usage line for cmd.
+func usage(prefix string, cmd Command) string {
+	args := cmd.Usage()
+	if as, ok := cmd.(ArgSpecifier); ok && args == "" {
+		args = as.ArgSpec().Usage()
+	}
+
+	u := prefix + cmd.Name()
+	if args != "" {
+		u += " " + args
+	}
+	return u
+}
+
+// parseArgs validates raw arguments against the command's spec, if it has
+// one.
+func parseArgs(cmd Command, raw []string) (Args, error) {
+	if as, ok := cmd.(ArgSpecifier); ok {
+		return as.ArgSpec().Parse(raw)
+	}
+
+	return NewArgs(raw...), nil
+}
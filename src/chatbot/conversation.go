@@ -0,0 +1,154 @@
+package chatbot
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultConversationTimeout is how long a parked conversation waits
+	// for its next message.
+	defaultConversationTimeout = 5 * time.Minute
+)
+
+var errNoConversations = errors.New("event is not part of a conversation")
+
+// conversationKey identifies a conversation with a user.
+type conversationKey struct {
+	gateway Gateway
+	channel Destination
+	user    string
+}
+
+func newConversationKey(e Event) conversationKey {
+	return conversationKey{
+		gateway: e.Gateway,
+		channel: e.Message.Channel,
+		user:    e.Message.UserID,
+	}
+}
+
+// parkedState is a state waiting for the next message in a conversation.
+type parkedState struct {
+	next    State
+	expires time.Time
+}
+
+// conversations tracks conversations waiting for a user's next message.
+type conversations struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	parked  map[conversationKey]parkedState
+}
+
+// newConversations creates an instance of conversations.
+func newConversations(timeout time.Duration) *conversations {
+	return &conversations{
+		timeout: timeout,
+		parked:  make(map[conversationKey]parkedState),
+	}
+}
+
+// SetTimeout sets how long conversations wait for the next message.
+func (c *conversations) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timeout = timeout
+}
+
+// Park stores next as the handler for the next message in the
+// conversation the event belongs to.
+func (c *conversations) Park(e Event, next State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	c.parked[newConversationKey(e)] = parkedState{
+		next:    next,
+		expires: now.Add(c.timeout),
+	}
+}
+
+// Resume removes and returns the state parked for the conversation the
+// event belongs to.
+func (c *conversations) Resume(e Event) (State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(time.Now())
+
+	key := newConversationKey(e)
+	ps, ok := c.parked[key]
+	if !ok {
+		return nil, false
+	}
+
+	delete(c.parked, key)
+	return ps.next, true
+}
+
+// Cancel discards the state parked for the conversation the event
+// belongs to. It returns false if there was no conversation.
+func (c *conversations) Cancel(e Event) bool {
+	_, ok := c.Resume(e)
+	return ok
+}
+
+// expire removes conversations which have timed out. The caller must
+// hold c.mu.
+func (c *conversations) expire(now time.Time) {
+	for key, ps := range c.parked {
+		if now.After(ps.expires) {
+			delete(c.parked, key)
+		}
+	}
+}
+
+// Await ends handling of the current event and continues the conversation
+// with next when the sender's next message arrives in the same channel.
+func Await(next State) State {
+	return func(e Event) State {
+		if e.conversations == nil {
+			return errorState(errNoConversations)
+		}
+
+		e.conversations.Park(e, next)
+		return nil
+	}
+}
+
+// Prompt replies with question and awaits the answer, which is handled by
+// next.
+func Prompt(question string, next State) State {
+	return func(e Event) State {
+		e.Reply(question)
+		return Await(next)
+	}
+}
+
+// cancelCommand abandons a conversation with the bot.
+type cancelCommand struct{}
+
+var _ Command = (*cancelCommand)(nil)
+var _ Describer = (*cancelCommand)(nil)
+
+func (cancelCommand) Name() string       { return "cancel" }
+func (cancelCommand) Aliases() []string  { return nil }
+func (cancelCommand) Usage() string      { return "" }
+func (cancelCommand) Synopsis() string   { return "Abandon a conversation with the bot." }
+func (cancelCommand) Examples() []string { return []string{"cancel"} }
+
+func (cancelCommand) Handle(args Args) (State, error) {
+	return func(e Event) State {
+		if e.conversations == nil || !e.conversations.Cancel(e) {
+			e.Reply("there is nothing to cancel")
+			return nil
+		}
+
+		e.Reply("cancelled")
+		return nil
+	}, nil
+}
@@ -4,9 +4,9 @@ package chatbot
 
 import "fmt"
 
-const _EventType_name = "AddEventMessageEvent"
+const _EventType_name = "AddEventMessageEventActionEventRemoveEvent"
 
-var _EventType_index = [...]uint8{0, 8, 20}
+var _EventType_index = [...]uint8{0, 8, 20, 31, 42}
 
 func (i EventType) String() string {
 	if i < 0 || i >= EventType(len(_EventType_index)-1) {
@@ -0,0 +1,59 @@
+package chatbot
+
+// Formatter renders rich text for a gateway.
+type Formatter interface {
+	Bold(s string) string
+	Code(s string) string
+	// Mention refers to a user so the gateway notifies them.
+	Mention(userID, userName string) string
+}
+
+// formatterGateway is implemented by gateways which support rich text.
+type formatterGateway interface {
+	Formatter() Formatter
+}
+
+// formatterFor returns the formatter for gw. Gateways without rich text
+// support get plain text.
+func formatterFor(gw Gateway) Formatter {
+	if fg, ok := gw.(formatterGateway); ok {
+		return fg.Formatter()
+	}
+
+	return plainFormatter{}
+}
+
+// plainFormatter renders text without formatting.
+type plainFormatter struct{}
+
+func (plainFormatter) Bold(s string) string { return s }
+func (plainFormatter) Code(s string) string { return s }
+func (plainFormatter) Mention(userID, userName string) string {
+	return displayName(userID, userName)
+}
+
+// slackFormatter renders text using slack markup.
+type slackFormatter struct{}
+
+func (slackFormatter) Bold(s string) string { return "*" + s + "*" }
+func (slackFormatter) Code(s string) string { return "`" + s + "`" }
+func (slackFormatter) Mention(userID, userName string) string {
+	return "<@" + userID + ">"
+}
+
+// ircFormatter renders text using IRC control codes.
+type ircFormatter struct{}
+
+func (ircFormatter) Bold(s string) string { return "\x02" + s + "\x02" }
+func (ircFormatter) Code(s string) string { return s }
+func (ircFormatter) Mention(userID, userName string) string {
+	return displayName(userID, userName)
+}
+
+// displayName returns userName, or userID if the name isn't known.
+func displayName(userID, userName string) string {
+	if userName == "" {
+		return userID
+	}
+	return userName
+}
@@ -0,0 +1,113 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotRunning is returned when a gateway is used while it isn't
+// running.
+var ErrNotRunning = errors.New("gateway is not running")
+
+// sendEvent sends e on events unless ctx is done first. It returns false
+// if the event wasn't sent.
+func sendEvent(ctx context.Context, events chan<- Event, e Event) bool {
+	select {
+	case events <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ThreadTeller is implemented by gateways which can send a message into a
+// thread. Gateways without threads send replies to the channel instead.
+type ThreadTeller interface {
+	// TellThread sends msg to the thread in dest. If broadcast is true,
+	// the message is also shown in the channel.
+	TellThread(dest Destination, thread, msg string, broadcast bool) error
+}
+
+// MessageReplier is implemented by gateways which reply to some messages
+// other than by sending to their channel, e.g. slack slash commands, which
+// are answered through their response URL.
+type MessageReplier interface {
+	ReplyTo(m Message, msg string, broadcast bool) error
+}
+
+const (
+	// minBackoff and maxBackoff bound the delay between reconnection
+	// attempts.
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// ConnectionState is the state of a gateway's connection.
+type ConnectionState int
+
+const (
+	// Disconnected gateways aren't connected and aren't trying to be.
+	Disconnected ConnectionState = iota
+	// Connecting gateways are trying to connect.
+	Connecting
+	// Connected gateways are connected.
+	Connected
+	// Reconnecting gateways lost their connection and are waiting to try
+	// again.
+	Reconnecting
+)
+
+var connectionStateNames = map[ConnectionState]string{
+	Disconnected: "disconnected",
+	Connecting:   "connecting",
+	Connected:    "connected",
+	Reconnecting: "reconnecting",
+}
+
+func (s ConnectionState) String() string {
+	if name, ok := connectionStateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// GatewayStatus describes a gateway's connection.
+type GatewayStatus struct {
+	State ConnectionState
+	// Since is when the gateway entered State.
+	Since time.Time
+	// Attempts is the number of failed connection attempts since the
+	// gateway was last connected.
+	Attempts int
+	// LastError is why the gateway last failed to connect or lost its
+	// connection.
+	LastError error
+	// Detail is gateway specific, e.g. the server and nick.
+	Detail string
+}
+
+// StatusReporter is implemented by gateways which report the status of
+// their connection.
+type StatusReporter interface {
+	Status() GatewayStatus
+}
+
+// backoff returns how long to wait before a reconnection attempt. The delay
+// doubles with each attempt and is jittered so clients don't reconnect in
+// lockstep.
+func backoff(attempt int) time.Duration {
+	d := minBackoff
+	for i := 0; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,216 @@
+package chatbot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxSuggestionDistance is the largest edit distance between an
+	// unknown command and a registered command for it to be suggested.
+	maxSuggestionDistance = 2
+)
+
+// Describer is implemented by commands which provide extended help.
+type Describer interface {
+	// Synopsis is a one line description of the command.
+	Synopsis() string
+	// Examples are example invocations of the command, without the
+	// command prefix.
+	Examples() []string
+}
+
+// helpCommand describes the registered commands.
+type helpCommand struct {
+	commands *registry
+}
+
+var _ Command = (*helpCommand)(nil)
+var _ Describer = (*helpCommand)(nil)
+var _ ArgSpecifier = (*helpCommand)(nil)
+
+func (helpCommand) Name() string      { return "help" }
+func (helpCommand) Aliases() []string { return nil }
+func (helpCommand) Usage() string     { return "" }
+func (helpCommand) Synopsis() string  { return "Describe the bot's commands." }
+
+func (helpCommand) Examples() []string {
+	return []string{"help", "help weather"}
+}
+
+func (helpCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{Name: "command", Help: "The command to describe.", Optional: true},
+		},
+	}
+}
+
+func (h helpCommand) Handle(args Args) (State, error) {
+	if !args.Has("command") {
+		return h.listState(), nil
+	}
+
+	return func(e Event) State {
+		name := strings.TrimPrefix(args.String("command"), e.Prefix())
+		cmd, ok := h.commands.Lookup(name)
+		if !ok {
+			return unknownState([]string{name}, h.commands.Suggest(name))
+		}
+
+		return h.commandState(cmd)
+	}, nil
+}
+
+func (h helpCommand) listState() State {
+	return func(e Event) State {
+		f := e.Formatter()
+
+		lines := []string{"Available commands:"}
+		for _, cmd := range h.commands.Commands() {
+			line := f.Bold(usage(e.Prefix(), cmd))
+			if synopsis := synopsis(cmd); synopsis != "" {
+				line += " - " + synopsis
+			}
+			lines = append(lines, line)
+		}
+		lines = append(lines, fmt.Sprintf("Use %s for details.",
+			f.Code(e.Prefix()+"help <command>")))
+
+		e.Reply(strings.Join(lines, "\n"))
+		return nil
+	}
+}
+
+func (h helpCommand) commandState(cmd Command) State {
+	return func(e Event) State {
+		f := e.Formatter()
+
+		lines := []string{"usage: " + f.Bold(usage(e.Prefix(), cmd))}
+		if synopsis := synopsis(cmd); synopsis != "" {
+			lines = append(lines, synopsis)
+		}
+		if as, ok := cmd.(ArgSpecifier); ok {
+			lines = append(lines, argumentLines(f, as.ArgSpec())...)
+		}
+		if aliases := cmd.Aliases(); len(aliases) > 0 {
+			lines = append(lines, "aliases: "+strings.Join(aliases, ", "))
+		}
+		if d, ok := cmd.(Describer); ok && len(d.Examples()) > 0 {
+			lines = append(lines, "examples:")
+			for _, example := range d.Examples() {
+				lines = append(lines, "  "+f.Code(e.Prefix()+example))
+			}
+		}
+
+		e.Reply(strings.Join(lines, "\n"))
+		return nil
+	}
+}
+
+// argumentLines describes the arguments and flags in spec.
+func argumentLines(f Formatter, spec ArgSpec) []string {
+	if len(spec.Args) == 0 && len(spec.Flags) == 0 {
+		return nil
+	}
+
+	lines := []string{"arguments:"}
+	for _, a := range spec.Args {
+		line := "  " + f.Code("<"+a.Name+">")
+		if a.Type != StringArg {
+			line += " (" + a.Type.String() + ")"
+		}
+		if a.Help != "" {
+			line += " " + a.Help
+		}
+		lines = append(lines, line)
+	}
+	for _, fl := range spec.Flags {
+		line := "  " + f.Code("--"+fl.Name)
+		if fl.Type != BoolArg {
+			line += " (" + fl.Type.String() + ")"
+		}
+		if fl.Help != "" {
+			line += " " + fl.Help
+		}
+		if fl.Default != "" {
+			line += " (default " + fl.Default + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// synopsis returns the synopsis of cmd if it has one.
+func synopsis(cmd Command) string {
+	if d, ok := cmd.(Describer); ok {
+		return d.Synopsis()
+	}
+
+	return ""
+}
+
+// Suggest returns the names and aliases of registered commands which are
+// close to name, closest first.
+func (r *registry) Suggest(name string) []string {
+	type suggestion struct {
+		name     string
+		distance int
+	}
+
+	var suggestions []suggestion
+	for candidate := range r.commands {
+		d := editDistance(name, candidate)
+		if d <= maxSuggestionDistance && d < len(candidate) {
+			suggestions = append(suggestions, suggestion{name: candidate, distance: d})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+
+	names := make([]string, len(suggestions))
+	for i := range suggestions {
+		names[i] = suggestions[i].name
+	}
+
+	return names
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,274 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxImageSize is the largest image the image server stores.
+	maxImageSize = 10 << 20
+	// defaultImageTTL is how long hosted images are served for.
+	defaultImageTTL = time.Hour
+	// defaultImageMaxBytes is how much image data the image server keeps
+	// before evicting the oldest images.
+	defaultImageMaxBytes = 256 << 20
+	// imagePath is where images are served from.
+	imagePath = "/images/"
+	// imageSweepInterval is how often expired images are removed.
+	imageSweepInterval = time.Minute
+	// imageShutdownTimeout is how long to wait for requests in flight
+	// when the image server stops.
+	imageShutdownTimeout = 5 * time.Second
+)
+
+// ErrNoImageHost is returned when a gateway which can't upload images is
+// asked to display one without an image host to link to.
+var ErrNoImageHost = errors.New("no image host configured")
+
+// imageExtensions are the file extensions added to image URLs so clients
+// can tell they are images.
+var imageExtensions = map[string]string{
+	"image/bmp":  ".bmp",
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// ImageHost stores images and returns a URL each can be viewed at.
+type ImageHost interface {
+	Host(imageData io.Reader) (string, error)
+}
+
+// ImageHosted is implemented by gateways which can't upload images. They
+// display an image by posting a link to a hosted copy.
+type ImageHosted interface {
+	SetImageHost(host ImageHost)
+}
+
+type hostedImage struct {
+	data        []byte
+	contentType string
+	expires     time.Time
+}
+
+// ImageServer is an ImageHost which serves images over HTTP. Each image is
+// stored in memory under a random URL until it expires, or until it is the
+// oldest image and newer ones need its space.
+type ImageServer struct {
+	addr     string
+	baseURL  string
+	ttl      time.Duration
+	maxBytes int
+	logger   *logrus.Entry
+
+	mu     sync.Mutex
+	images map[string]hostedImage
+	// order is the IDs of stored images, oldest first.
+	order []string
+	// size is the total size of stored images.
+	size int
+}
+
+var _ ImageHost = (*ImageServer)(nil)
+
+// NewImageServer creates an instance of ImageServer which listens on addr.
+// baseURL is the address the server is reachable at by chat users, e.g.
+// "https://bot.example.com". Images expire after ttl, or an hour if ttl
+// is zero.
+func NewImageServer(addr, baseURL string, ttl time.Duration) *ImageServer {
+	if ttl <= 0 {
+		ttl = defaultImageTTL
+	}
+
+	return &ImageServer{
+		addr:     addr,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		ttl:      ttl,
+		maxBytes: defaultImageMaxBytes,
+		logger:   logrus.WithField("imageServer", addr),
+		images:   make(map[string]hostedImage),
+	}
+}
+
+// SetMaxBytes sets how much image data is kept. The oldest images are
+// evicted to make room for new ones. It defaults to 256MB.
+func (s *ImageServer) SetMaxBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxBytes = n
+}
+
+// URL returns the URL every hosted image's URL starts with, e.g.
+// "https://bot.example.com/images/".
+func (s *ImageServer) URL() string {
+	return s.baseURL + imagePath
+}
+
+// Host stores an image and returns its URL. Only data recognised as an
+// image is accepted.
+func (s *ImageServer) Host(imageData io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(imageData, maxImageSize+1))
+	if err != nil {
+		return "", errors.Wrap(err, "read image")
+	}
+	if len(data) > maxImageSize {
+		return "", errors.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", errors.Errorf("unsupported image type %q", contentType)
+	}
+
+	id, err := imageID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	if len(data) > s.maxBytes {
+		s.mu.Unlock()
+		return "", errors.Errorf("image is larger than the %d bytes kept", s.maxBytes)
+	}
+	for s.size+len(data) > s.maxBytes {
+		s.evictOldest()
+	}
+	s.images[id] = hostedImage{
+		data:        data,
+		contentType: contentType,
+		expires:     time.Now().Add(s.ttl),
+	}
+	s.order = append(s.order, id)
+	s.size += len(data)
+	s.mu.Unlock()
+
+	return s.URL() + id + imageExtensions[contentType], nil
+}
+
+// ServeHTTP serves hosted images.
+func (s *ImageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, imagePath)
+	if name == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.SplitN(name, ".", 2)[0]
+
+	img, ok := s.image(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Expires", img.expires.UTC().Format(http.TimeFormat))
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(img.data))
+}
+
+// image returns the image stored as id, unless it has expired.
+func (s *ImageServer) image(id string) (hostedImage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	img, ok := s.images[id]
+	if !ok || time.Now().After(img.expires) {
+		return hostedImage{}, false
+	}
+
+	return img, true
+}
+
+// sweep removes expired images. Every image is kept for the same time, so
+// the expired images are the oldest.
+func (s *ImageServer) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.order) > 0 && now.After(s.images[s.order[0]].expires) {
+		s.evictOldest()
+	}
+}
+
+// evictOldest removes the oldest image. s.mu must be held.
+func (s *ImageServer) evictOldest() {
+	id := s.order[0]
+	s.order = s.order[1:]
+	s.size -= len(s.images[id].data)
+	delete(s.images, id)
+}
+
+// Start serves images until ctx is cancelled.
+func (s *ImageServer) Start(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.addr,
+		Handler: s,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		s.logger.Info("starting image server")
+		errs <- srv.ListenAndServe()
+	}()
+
+	ticker := time.NewTicker(imageSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-ctx.Done():
+			s.logger.Info("shutting down image server")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), imageShutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		}
+	}
+}
+
+// captionLink returns the link posted to display a hosted image, preceded
+// by the image's title and comment, if it has them.
+func captionLink(imageData io.Reader, url string) string {
+	title, comment := imageCaption(imageData)
+
+	var parts []string
+	for _, s := range []string{comment, title, url} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// imageID returns a random, unguessable image identifier.
+func imageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate image id")
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,207 @@
+package chatbot
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestImageServer serves s over HTTP, with image URLs pointing at the
+// test server.
+func newTestImageServer(ttl time.Duration) (*ImageServer, *httptest.Server) {
+	s := NewImageServer("", "", ttl)
+	ts := httptest.NewServer(s)
+	s.baseURL = ts.URL
+	return s, ts
+}
+
+// get fetches url and returns the response's status, content type and
+// body.
+func get(t *testing.T, url string) (int, string, []byte) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read %s: %v", url, err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), body
+}
+
+func testImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	var buf bytes.Buffer
+	if err := encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageServerHost(t *testing.T) {
+	s, ts := newTestImageServer(time.Hour)
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		ext         string
+	}{
+		{name: "png", data: testPNG(t), contentType: "image/png", ext: ".png"},
+		{
+			name: "gif",
+			data: testImage(t, func(buf *bytes.Buffer, img image.Image) error {
+				return gif.Encode(buf, img, nil)
+			}),
+			contentType: "image/gif",
+			ext:         ".gif",
+		},
+		{
+			name: "jpeg",
+			data: testImage(t, func(buf *bytes.Buffer, img image.Image) error {
+				return jpeg.Encode(buf, img, nil)
+			}),
+			contentType: "image/jpeg",
+			ext:         ".jpg",
+		},
+		{name: "bmp", data: append([]byte("BM"), make([]byte, 64)...), contentType: "image/bmp", ext: ".bmp"},
+		{name: "webp", data: append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 64)...), contentType: "image/webp", ext: ".webp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := s.Host(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Host() error = %v", err)
+			}
+			if !strings.HasPrefix(url, ts.URL+imagePath) || !strings.HasSuffix(url, tt.ext) {
+				t.Errorf("Host() = %q, want a URL under %s ending in %s", url, ts.URL+imagePath, tt.ext)
+			}
+
+			status, contentType, body := get(t, url)
+			if status != http.StatusOK {
+				t.Fatalf("GET status = %d, want %d", status, http.StatusOK)
+			}
+			if contentType != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tt.contentType)
+			}
+			if !bytes.Equal(body, tt.data) {
+				t.Errorf("served %d bytes, want the %d hosted", len(body), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestImageServerRejectsNonImages(t *testing.T) {
+	s, ts := newTestImageServer(time.Hour)
+	defer ts.Close()
+
+	if _, err := s.Host(strings.NewReader("<html><script>alert(1)</script></html>")); err == nil {
+		t.Error("Host() accepted html")
+	}
+	if _, err := s.Host(bytes.NewReader(make([]byte, maxImageSize+1))); err == nil {
+		t.Error("Host() accepted an oversized image")
+	}
+}
+
+func TestImageServerNotFound(t *testing.T) {
+	s, ts := newTestImageServer(time.Hour)
+	defer ts.Close()
+
+	url, err := s.Host(bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   int
+	}{
+		{name: "unknown image", method: http.MethodGet, url: ts.URL + imagePath + "0123456789abcdef.png", want: http.StatusNotFound},
+		{name: "outside image path", method: http.MethodGet, url: ts.URL + "/other", want: http.StatusNotFound},
+		{name: "post", method: http.MethodPost, url: url, want: http.StatusMethodNotAllowed},
+		{name: "head", method: http.MethodHead, url: url, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageServerExpiry(t *testing.T) {
+	s, ts := newTestImageServer(50 * time.Millisecond)
+	defer ts.Close()
+
+	url, err := s.Host(bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := get(t, url); status != http.StatusOK {
+		t.Fatalf("status before expiry = %d, want %d", status, http.StatusOK)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if status, _, _ := get(t, url); status != http.StatusNotFound {
+		t.Errorf("status after expiry = %d, want %d", status, http.StatusNotFound)
+	}
+
+	s.sweep(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.images) != 0 || len(s.order) != 0 || s.size != 0 {
+		t.Errorf("sweep left %d images, %d ids, %d bytes", len(s.images), len(s.order), s.size)
+	}
+}
+
+func TestImageServerEvictsOldest(t *testing.T) {
+	s, ts := newTestImageServer(time.Hour)
+	defer ts.Close()
+
+	data := testPNG(t)
+	s.SetMaxBytes(2 * len(data))
+
+	var urls []string
+	for i := 0; i < 3; i++ {
+		url, err := s.Host(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+
+	want := []int{http.StatusNotFound, http.StatusOK, http.StatusOK}
+	for i, url := range urls {
+		if status, _, _ := get(t, url); status != want[i] {
+			t.Errorf("image %d status = %d, want %d", i, status, want[i])
+		}
+	}
+
+	s.SetMaxBytes(len(data) - 1)
+	if _, err := s.Host(bytes.NewReader(data)); err == nil {
+		t.Error("Host() accepted an image larger than the server keeps")
+	}
+}
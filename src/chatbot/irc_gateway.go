@@ -1,100 +1,500 @@
 package chatbot
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	irc "github.com/fluffle/goirc/client"
+	"github.com/pkg/errors"
 )
 
+const (
+	// ircQuitTimeout is how long to wait for the server to close the
+	// connection after quitting.
+	ircQuitTimeout = 5 * time.Second
+	// ircNickRetryInterval is how often to try to get the bot's nick back
+	// when it was taken while reconnecting.
+	ircNickRetryInterval = 30 * time.Second
+)
+
+// IRCChannel is an irc channel and its key, if it has one.
+type IRCChannel struct {
+	Name string
+	Key  string
+}
+
+// ParseIRCChannel parses a channel given as "#name" or "#name:key".
+func ParseIRCChannel(s string) IRCChannel {
+	parts := strings.SplitN(s, ":", 2)
+	ch := IRCChannel{Name: parts[0]}
+	if len(parts) == 2 {
+		ch.Key = parts[1]
+	}
+
+	return ch
+}
+
+// IRCConfig configures an IRCGateway.
+type IRCConfig struct {
+	BotName string
+	// Channels are joined once connected.
+	Channels []IRCChannel
+
+	// Server is the irc server's host name.
+	Server string
+	// Port defaults to 6697 with TLS and 6667 without.
+	Port int
+	// Password is the server password, if the server requires one.
+	Password string
+
+	TLS bool
+	// CAFile is a PEM file of certificate authorities to verify the
+	// server with instead of the system's.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key,
+	// presented to the server for CertFP or SASL EXTERNAL.
+	CertFile string
+	KeyFile  string
+
+	// SASLMechanism is "PLAIN" or "EXTERNAL" to authenticate with SASL.
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+
+	// NickServPassword identifies the bot's nick with NickServ once
+	// connected.
+	NickServPassword string
+}
+
+// address returns the server's host and port.
+func (cfg IRCConfig) address() string {
+	if cfg.Port == 0 {
+		return cfg.Server
+	}
+
+	return net.JoinHostPort(cfg.Server, strconv.Itoa(cfg.Port))
+}
+
+// tlsConfig creates the tls configuration for connecting to the server.
+func (cfg IRCConfig) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{ServerName: cfg.Server}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read irc CA file")
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load irc client certificate")
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
 // IRCGateway is a gateway for chatting via IRC.
 type IRCGateway struct {
+	cfg     IRCConfig
 	botName string
-	botChan string
 	logger  *logrus.Entry
 	events  chan Event
-	conn    *irc.Conn
+	// conn is created with the gateway, so it can be used without
+	// locking while the gateway starts.
+	conn   *irc.Conn
+	images ImageHost
+
+	mu sync.RWMutex
+	// channels maps the lower cased names of joined channels to their
+	// keys.
+	channels map[string]IRCChannel
+	status   GatewayStatus
+	// lost is closed when the current connection ends.
+	lost chan struct{}
+	// dropped is why the bot dropped the current connection, if it did.
+	dropped error
+}
+
+// ircHandlers are handlers added to a connection, which are removed when
+// the gateway stops.
+type ircHandlers []irc.Remover
+
+func (h *ircHandlers) add(conn *irc.Conn, name string, f irc.HandlerFunc) {
+	*h = append(*h, conn.HandleFunc(name, f))
 }
 
-var _ Gateway = (*IRCGateway)(nil)
+func (h ircHandlers) remove() {
+	for _, r := range h {
+		r.Remove()
+	}
+}
+
+var (
+	_ Gateway     = (*IRCGateway)(nil)
+	_ ImageHosted = (*IRCGateway)(nil)
+)
 
 // NewIRCGateway creates an instance of IRCGateway.
-func NewIRCGateway(botName, botChan string) *IRCGateway {
+func NewIRCGateway(cfg IRCConfig) *IRCGateway {
 	logger := logrus.StandardLogger().WithFields(logrus.Fields{
 		"gateway": "irc",
-		"botName": botName,
-		"botChan": botChan,
+		"botName": cfg.BotName,
+		"server":  cfg.address(),
 	})
 
+	channels := make(map[string]IRCChannel)
+	for _, ch := range cfg.Channels {
+		channels[strings.ToLower(ch.Name)] = ch
+	}
+
+	ircCfg := irc.NewConfig(cfg.BotName)
+	ircCfg.Server = cfg.address()
+	ircCfg.Pass = cfg.Password
+	ircCfg.NewNick = func(n string) string { return n + "^" }
+	ircCfg.QuitMessage = "dying"
+
 	return &IRCGateway{
-		botName: botName,
-		botChan: botChan,
-		logger:  logger,
-		events:  make(chan Event),
+		cfg:      cfg,
+		botName:  cfg.BotName,
+		logger:   logger,
+		events:   make(chan Event),
+		conn:     irc.Client(ircCfg),
+		channels: channels,
+		status:   GatewayStatus{State: Disconnected, Since: time.Now()},
 	}
 }
 
+// Name is the name of the gateway.
+func (g *IRCGateway) Name() string {
+	return "irc"
+}
+
 // Events are events from the IRCGateway.
 func (g *IRCGateway) Events() <-chan Event {
 	return g.events
 }
 
-// Start starts the irc gateway.
-func (g *IRCGateway) Start(errChan chan error) {
-	cfg := irc.NewConfig(g.botName)
-	cfg.SSL = true
-	cfg.SSLConfig = &tls.Config{ServerName: "irc.freenode.net"}
-	cfg.Server = "irc.freenode.net:7000"
-	cfg.NewNick = func(n string) string { return n + "^" }
+// Start connects to irc and runs until ctx is cancelled. Lost connections
+// are retried with exponential backoff.
+func (g *IRCGateway) Start(ctx context.Context) error {
+	if g.cfg.TLS {
+		tc, err := g.cfg.tlsConfig()
+		if err != nil {
+			return err
+		}
+		cfg := g.conn.Config()
+		cfg.SSL = true
+		cfg.SSLConfig = tc
+	}
+
+	removeSASL, err := g.handleSASL(g.conn)
+	if err != nil {
+		return err
+	}
+	defer removeSASL()
 
-	g.conn = irc.Client(cfg)
+	var handlers ircHandlers
+	defer handlers.remove()
+
+	handlers.add(g.conn, irc.DISCONNECTED,
+		func(conn *irc.Conn, line *irc.Line) {
+			g.connectionLost()
+		})
 
-	g.conn.HandleFunc(irc.CONNECTED,
+	handlers.add(g.conn, irc.CONNECTED,
 		func(conn *irc.Conn, line *irc.Line) {
-			conn.Join(g.botChan)
-			g.logger.Info("joined channel")
+			g.setState(Connected, nil)
+
+			if g.cfg.NickServPassword != "" {
+				conn.Privmsg("NickServ", "IDENTIFY "+g.botName+" "+g.cfg.NickServPassword)
+			}
+
+			g.mu.RLock()
+			defer g.mu.RUnlock()
+			for _, ch := range g.channels {
+				conn.Join(ch.Name, ch.Key)
+				g.logger.WithField("channel", ch.Name).Info("joined channel")
+			}
+
+			if conn.Me().Nick != g.botName {
+				go g.regainNick(ctx, conn, g.lost)
+			}
 		})
 
-	g.conn.HandleFunc(irc.PRIVMSG,
+	handlers.add(g.conn, irc.PRIVMSG,
 		func(conn *irc.Conn, line *irc.Line) {
-			if line.Args[0] == g.botChan {
+			if line.Nick == conn.Me().Nick {
+				return
+			}
+
+			if !line.Public() || g.joined(line.Target()) {
 				g.logger.Info("sending event")
-				g.events <- Event{
+				sendEvent(ctx, g.events, Event{
 					Gateway: g,
 					Type:    MessageEvent,
-					Creator: line.Args[0],
-					Payload: strings.Join(line.Args[1:], " "),
-				}
+					Message: Message{
+						Channel:   Destination(line.Target()),
+						UserID:    line.Src,
+						UserName:  line.Nick,
+						Timestamp: line.Time,
+						Direct:    !line.Public(),
+						Text:      strings.Join(line.Args[1:], " "),
+						Raw:       line,
+					},
+				})
 				g.logger.Info("sent event")
 			}
 		})
 
-	// Tell client to connect.
-	g.logger.Info("connecting to irc")
-	if err := g.conn.Connect(); err != nil {
-		g.logger.WithError(err).Error("connection failure")
+	for {
+		g.setState(Connecting, nil)
+		g.logger.Info("connecting to irc")
+
+		lost := g.connecting()
+		if err := g.conn.Connect(); err != nil {
+			g.logger.WithError(err).Error("connection failure")
+			g.setState(Reconnecting, errors.Wrap(err, "connect to irc"))
+		} else {
+			select {
+			case <-ctx.Done():
+				g.logger.Info("shutting down")
+				g.conn.Quit()
+				select {
+				case <-lost:
+				case <-time.After(ircQuitTimeout):
+					g.logger.Warn("timed out waiting to disconnect")
+				}
+				g.setState(Disconnected, nil)
+				return nil
+			case <-lost:
+				err := g.dropError()
+				if err == nil {
+					err = errors.New("disconnected from irc")
+				}
+				g.logger.WithError(err).Warn("disconnected from irc")
+				g.setState(Reconnecting, err)
+			}
+		}
+
+		delay := backoff(g.Status().Attempts - 1)
+		g.logger.WithField("delay", delay).Info("waiting to reconnect")
+		select {
+		case <-ctx.Done():
+			g.setState(Disconnected, nil)
+			return nil
+		case <-time.After(delay):
+		}
 	}
 }
 
-// Stop the irc gateway.
-func (g *IRCGateway) Stop() {
-	g.logger.Info("shutting down")
+// connecting returns the channel which is closed when the connection
+// about to be made is lost.
+func (g *IRCGateway) connecting() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	if g.conn != nil {
-		g.conn.Quit("dying")
+	g.lost = make(chan struct{})
+	g.dropped = nil
+	return g.lost
+}
+
+// dropConnection records why the bot is dropping the current connection.
+func (g *IRCGateway) dropConnection(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.dropped = err
+}
+
+// dropError returns why the bot dropped the current connection, or nil
+// if it didn't.
+func (g *IRCGateway) dropError() error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.dropped
+}
+
+// connectionLost closes the current connection's lost channel. Every
+// goroutine waiting on the connection sees it end.
+func (g *IRCGateway) connectionLost() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.lost != nil {
+		close(g.lost)
+		g.lost = nil
+	}
+}
+
+// regainNick tries to change back to the bot's nick until it succeeds or
+// the connection is lost.
+func (g *IRCGateway) regainNick(ctx context.Context, conn *irc.Conn, lost <-chan struct{}) {
+	ticker := time.NewTicker(ircNickRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if g.cfg.NickServPassword != "" {
+			conn.Privmsg("NickServ", "GHOST "+g.botName+" "+g.cfg.NickServPassword)
+		}
+		conn.Nick(g.botName)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		if !conn.Connected() || conn.Me().Nick == g.botName {
+			return
+		}
+	}
+}
+
+// setState records a change in the connection's state. Failed attempts are
+// counted until the bot connects.
+func (g *IRCGateway) setState(state ConnectionState, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch state {
+	case Connected:
+		g.status.Attempts = 0
+	case Reconnecting:
+		g.status.Attempts++
+	}
+
+	g.status.State = state
+	g.status.Since = time.Now()
+	if err != nil {
+		g.status.LastError = err
 	}
 }
 
-// Tell sends a message to a destination.
+// Status reports the state of the irc connection.
+func (g *IRCGateway) Status() GatewayStatus {
+	g.mu.RLock()
+	status := g.status
+	g.mu.RUnlock()
+
+	status.Detail = fmt.Sprintf("%s as %s", g.cfg.address(), g.conn.Me().Nick)
+
+	return status
+}
+
+// joined returns true if the bot is in channel.
+func (g *IRCGateway) joined(channel string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	_, ok := g.channels[strings.ToLower(channel)]
+	return ok
+}
+
+// Join joins a channel, which is rejoined if the bot reconnects.
+func (g *IRCGateway) Join(channel Destination, key string) error {
+	if !g.conn.Connected() {
+		return ErrNotRunning
+	}
+
+	ch := IRCChannel{Name: string(channel), Key: key}
+	if ch.Name == "" || !strings.ContainsAny(ch.Name[:1], "#&+!") {
+		return errors.Errorf("%q is not a channel", ch.Name)
+	}
+
+	g.mu.Lock()
+	g.channels[strings.ToLower(ch.Name)] = ch
+	g.mu.Unlock()
+
+	g.conn.Join(ch.Name, ch.Key)
+	g.logger.WithField("channel", ch.Name).Info("joined channel")
+	return nil
+}
+
+// Part leaves a channel.
+func (g *IRCGateway) Part(channel Destination) error {
+	if !g.conn.Connected() {
+		return ErrNotRunning
+	}
+
+	name := strings.ToLower(string(channel))
+
+	g.mu.Lock()
+	_, ok := g.channels[name]
+	delete(g.channels, name)
+	g.mu.Unlock()
+
+	if !ok {
+		return errors.Errorf("not in %s", channel)
+	}
+
+	g.conn.Part(string(channel))
+	g.logger.WithField("channel", channel).Info("left channel")
+	return nil
+}
+
+// Addressed returns the rest of msg if it starts with the bot's nick.
+func (g *IRCGateway) Addressed(msg string) (string, bool) {
+	return stripAddress(msg, g.botName, g.conn.Me().Nick)
+}
+
+// Formatter returns the formatter for IRC messages.
+func (g *IRCGateway) Formatter() Formatter {
+	return ircFormatter{}
+}
+
+// Tell sends a message to a destination. IRC messages can't span lines,
+// so each line of msg is sent separately.
 func (g *IRCGateway) Tell(dest Destination, msg string) error {
-	g.conn.Privmsg(string(dest), msg)
+	if !g.conn.Connected() {
+		return ErrNotRunning
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		g.conn.Privmsg(string(dest), line)
+	}
 	return nil
 }
 
-// Display displays an image.
+// SetImageHost sets where images are hosted for Display.
+func (g *IRCGateway) SetImageHost(host ImageHost) {
+	g.images = host
+}
+
+// Display displays an image by posting a link to a hosted copy.
 func (g *IRCGateway) Display(dest Destination, imageData io.Reader) error {
-	g.conn.Privmsg(string(dest), "one day i'll upload an image")
-	return nil
+	if g.images == nil {
+		return ErrNoImageHost
+	}
+	if !g.conn.Connected() {
+		return ErrNotRunning
+	}
+
+	url, err := g.images.Host(imageData)
+	if err != nil {
+		return err
+	}
+
+	return g.Tell(dest, captionLink(imageData, url))
 }
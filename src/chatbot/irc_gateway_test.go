@@ -0,0 +1,562 @@
+package chatbot
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ircStandInTimeout is how long the stand-in waits for the client.
+const ircStandInTimeout = 10 * time.Second
+
+// ircStandIn is a fake irc server which accepts one client and records
+// the lines it sends.
+type ircStandIn struct {
+	t    *testing.T
+	ln   net.Listener
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newIRCStandIn(t *testing.T, tc *tls.Config) *ircStandIn {
+	var ln net.Listener
+	var err error
+	if tc != nil {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", tc)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	return &ircStandIn{t: t, ln: ln}
+}
+
+// port returns the port the stand-in listens on.
+func (s *ircStandIn) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// accept waits for the client to connect.
+func (s *ircStandIn) accept() {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := s.ln.Accept()
+		accepted <- result{conn, err}
+	}()
+
+	select {
+	case res := <-accepted:
+		if res.err != nil {
+			s.t.Fatalf("accept: %v", res.err)
+		}
+		s.conn, s.r = res.conn, bufio.NewReader(res.conn)
+	case <-time.After(ircStandInTimeout):
+		s.t.Fatal("timed out waiting for the client to connect")
+	}
+}
+
+// next returns the next line the client sends.
+func (s *ircStandIn) next() string {
+	s.conn.SetReadDeadline(time.Now().Add(ircStandInTimeout))
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("read from client: %v", err)
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+// expect skips lines until one starts with prefix, and returns it.
+func (s *ircStandIn) expect(prefix string) string {
+	for {
+		if line := s.next(); strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+// send sends a line to the client.
+func (s *ircStandIn) send(line string) {
+	if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+		s.t.Fatalf("write to client: %v", err)
+	}
+}
+
+// expectClosed skips lines until the client closes the connection.
+func (s *ircStandIn) expectClosed() {
+	s.conn.SetReadDeadline(time.Now().Add(ircStandInTimeout))
+	for {
+		if _, err := s.r.ReadString('\n'); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.t.Fatal("timed out waiting for the client to disconnect")
+			}
+			return
+		}
+	}
+}
+
+func (s *ircStandIn) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.ln.Close()
+}
+
+// startIRCGateway starts a gateway with cfg, and returns a function which
+// stops it. The stand-in should be closed first, so the gateway doesn't
+// wait for it to acknowledge QUIT.
+func startIRCGateway(t *testing.T, cfg IRCConfig) (*IRCGateway, func()) {
+	g := NewIRCGateway(cfg)
+	// Flood protection would delay the later lines of each exchange.
+	g.conn.Config().Flood = true
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for range g.Events() {
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Start(ctx)
+	}()
+
+	return g, func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Start() = %v", err)
+			}
+		case <-time.After(ircQuitTimeout + ircStandInTimeout):
+			t.Error("timed out waiting for the gateway to stop")
+		}
+	}
+}
+
+// waitForStatus waits until the gateway's status satisfies ok.
+func waitForStatus(t *testing.T, g *IRCGateway, ok func(GatewayStatus) bool) GatewayStatus {
+	deadline := time.Now().Add(ircStandInTimeout)
+	for {
+		status := g.Status()
+		if ok(status) || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIRCGatewaySASLPlain(t *testing.T) {
+	s := newIRCStandIn(t, nil)
+
+	g, stop := startIRCGateway(t, IRCConfig{
+		BotName:          "bot",
+		Channels:         []IRCChannel{{Name: "#chan", Key: "key"}},
+		Server:           "127.0.0.1",
+		Port:             s.port(),
+		Password:         "server-password",
+		SASLMechanism:    "plain",
+		SASLUser:         "user",
+		SASLPassword:     "sasl-password",
+		NickServPassword: "nickserv-password",
+	})
+	defer stop()
+	defer s.close()
+
+	s.accept()
+
+	// The capability request must come before registration.
+	if got, want := s.next(), "CAP REQ :sasl"; got != want {
+		t.Fatalf("first line = %q, want %q", got, want)
+	}
+	if got, want := s.next(), "PASS server-password"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+	if got, want := s.next(), "NICK bot"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+	s.expect("USER ")
+
+	s.send(":irc.test CAP * ACK :sasl")
+	if got, want := s.next(), "AUTHENTICATE PLAIN"; got != want {
+		t.Fatalf("line = %q, want %q", got, want)
+	}
+
+	s.send("AUTHENTICATE +")
+	line := s.expect("AUTHENTICATE ")
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTHENTICATE "))
+	if err != nil {
+		t.Fatalf("decode %q: %v", line, err)
+	}
+	if got, want := string(payload), "user\x00user\x00sasl-password"; got != want {
+		t.Errorf("SASL payload = %q, want %q", got, want)
+	}
+
+	s.send(":irc.test 903 bot :SASL authentication successful")
+	if got, want := s.next(), "CAP END"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+
+	s.send(":irc.test 001 bot :Welcome bot!goirc@127.0.0.1")
+	if got, want := s.expect("PRIVMSG NickServ"), "PRIVMSG NickServ :IDENTIFY bot nickserv-password"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+	if got, want := s.expect("JOIN"), "JOIN #chan key"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+
+	status := waitForStatus(t, g, func(status GatewayStatus) bool {
+		return status.State == Connected
+	})
+	if status.State != Connected || status.LastError != nil {
+		t.Errorf("Status() = %v, %v, want Connected without an error", status.State, status.LastError)
+	}
+}
+
+func TestIRCGatewaySASLExternalTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irc-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+
+	serverCert := ca.issue(t, false)
+	clientCert := ca.issue(t, true)
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", clientCert.Certificate[0])
+	key, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, keyFile, "EC PRIVATE KEY", key)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	s := newIRCStandIn(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+
+	g, stop := startIRCGateway(t, IRCConfig{
+		BotName:       "bot",
+		Server:        "127.0.0.1",
+		Port:          s.port(),
+		TLS:           true,
+		CAFile:        caFile,
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		SASLMechanism: "EXTERNAL",
+	})
+	defer stop()
+	defer s.close()
+
+	s.accept()
+	if got, want := s.next(), "CAP REQ :sasl"; got != want {
+		t.Fatalf("first line = %q, want %q", got, want)
+	}
+	if peers := s.conn.(*tls.Conn).ConnectionState().PeerCertificates; len(peers) == 0 {
+		t.Error("client didn't present its certificate")
+	}
+	s.expect("USER ")
+
+	s.send(":irc.test CAP * ACK :sasl")
+	if got, want := s.next(), "AUTHENTICATE EXTERNAL"; got != want {
+		t.Fatalf("line = %q, want %q", got, want)
+	}
+	s.send("AUTHENTICATE +")
+	if got, want := s.next(), "AUTHENTICATE +"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+
+	s.send(":irc.test 903 bot :SASL authentication successful")
+	s.expect("CAP END")
+	s.send(":irc.test 001 bot :Welcome bot!goirc@127.0.0.1")
+
+	status := waitForStatus(t, g, func(status GatewayStatus) bool {
+		return status.State == Connected
+	})
+	if status.State != Connected || status.LastError != nil {
+		t.Errorf("Status() = %v, %v, want Connected without an error", status.State, status.LastError)
+	}
+}
+
+func TestIRCGatewaySASLUnsupported(t *testing.T) {
+	s := newIRCStandIn(t, nil)
+
+	g, stop := startIRCGateway(t, IRCConfig{
+		BotName:       "bot",
+		Server:        "127.0.0.1",
+		Port:          s.port(),
+		SASLMechanism: "PLAIN",
+		SASLUser:      "user",
+		SASLPassword:  "sasl-password",
+	})
+	defer stop()
+	defer s.close()
+
+	s.accept()
+	s.expect("USER ")
+	s.send(":irc.test 421 bot CAP :Unknown command")
+	s.send(":irc.test 001 bot :Welcome bot!goirc@127.0.0.1")
+	s.expectClosed()
+
+	status := waitForStatus(t, g, func(status GatewayStatus) bool {
+		return status.State == Reconnecting
+	})
+	if status.State != Reconnecting || status.LastError == nil ||
+		status.LastError.Error() != "registered without SASL authentication" {
+		t.Errorf("Status() = %v, %v, want Reconnecting after registering without SASL", status.State, status.LastError)
+	}
+}
+
+func TestIRCGatewaySASLFailed(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{name: "rejected", reply: ":irc.test 904 bot :SASL authentication failed"},
+		{name: "aborted", reply: ":irc.test 906 bot :SASL authentication aborted"},
+		{name: "not supported", reply: ":irc.test CAP * NAK :sasl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newIRCStandIn(t, nil)
+
+			g, stop := startIRCGateway(t, IRCConfig{
+				BotName:       "bot",
+				Server:        "127.0.0.1",
+				Port:          s.port(),
+				SASLMechanism: "PLAIN",
+				SASLUser:      "user",
+				SASLPassword:  "wrong-password",
+			})
+			defer stop()
+			defer s.close()
+
+			s.accept()
+			s.expect("USER ")
+			if !strings.Contains(tt.reply, "NAK") {
+				s.send(":irc.test CAP * ACK :sasl")
+				s.expect("AUTHENTICATE PLAIN")
+				s.send("AUTHENTICATE +")
+				s.expect("AUTHENTICATE ")
+			}
+
+			// The bot must not finish registering unauthenticated.
+			s.send(tt.reply)
+			s.conn.SetReadDeadline(time.Now().Add(ircStandInTimeout))
+			for {
+				line, err := s.r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if strings.HasPrefix(line, "CAP END") {
+					t.Errorf("bot sent %q after SASL failed", strings.TrimSpace(line))
+				}
+			}
+
+			status := waitForStatus(t, g, func(status GatewayStatus) bool {
+				return status.State == Reconnecting
+			})
+			if status.State != Reconnecting || status.LastError == nil || !strings.Contains(status.LastError.Error(), "SASL") {
+				t.Errorf("Status() = %v, %v, want Reconnecting with the SASL failure", status.State, status.LastError)
+			}
+		})
+	}
+}
+
+func TestIRCGatewaySASLCleanup(t *testing.T) {
+	count := func() int {
+		ircCapDialers.mu.Lock()
+		defer ircCapDialers.mu.Unlock()
+		return len(ircCapDialers.dialers)
+	}
+	before := count()
+
+	s := newIRCStandIn(t, nil)
+	defer s.close()
+
+	g, stop := startIRCGateway(t, IRCConfig{
+		BotName:       "bot",
+		Server:        "127.0.0.1",
+		Port:          s.port(),
+		SASLMechanism: "EXTERNAL",
+		CertFile:      "unused.pem",
+	})
+	s.accept()
+	s.expect("USER ")
+	if n := count(); n != before+1 {
+		t.Errorf("%d dialers while running, want %d", n, before+1)
+	}
+
+	s.conn.Close()
+	stop()
+	if n := count(); n != before {
+		t.Errorf("%d dialers after stopping, want %d", n, before)
+	}
+
+	// Stopping removes the handlers added to the connection, so a
+	// restarted gateway doesn't answer twice.
+	s2 := newIRCStandIn(t, nil)
+	defer s2.close()
+	g.conn.Config().Server = net.JoinHostPort("127.0.0.1", strconv.Itoa(s2.port()))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Start(ctx) }()
+	defer func() {
+		s2.close()
+		cancel()
+		<-done
+	}()
+
+	s2.accept()
+	s2.expect("USER ")
+	s2.send(":irc.test CAP * ACK :sasl")
+	s2.expect("AUTHENTICATE EXTERNAL")
+	s2.send(":irc.test PING :check")
+	if got, want := s2.next(), "PONG :check"; got != want {
+		t.Errorf("line = %q, want %q, the SASL handlers ran twice", got, want)
+	}
+}
+
+func TestIRCGatewayReconnectsWhileRegainingNick(t *testing.T) {
+	s := newIRCStandIn(t, nil)
+
+	g, stop := startIRCGateway(t, IRCConfig{
+		BotName: "bot",
+		Server:  "127.0.0.1",
+		Port:    s.port(),
+	})
+	defer stop()
+	defer s.close()
+
+	s.accept()
+	s.expect("NICK bot")
+	s.expect("USER ")
+	s.send(":irc.test 433 * bot :Nickname is already in use")
+	if got, want := s.next(), "NICK bot^"; got != want {
+		t.Fatalf("line = %q, want %q", got, want)
+	}
+	s.send(":irc.test 001 bot^ :Welcome bot^!goirc@127.0.0.1")
+
+	// The bot tries to take its nick back, and is dropped meanwhile.
+	s.expect("NICK bot")
+	waitForStatus(t, g, func(status GatewayStatus) bool {
+		return status.State == Connected
+	})
+	s.conn.Close()
+
+	// The bot reconnects under the nick it had, and tries again.
+	s.accept()
+	nick := strings.TrimPrefix(s.expect("NICK "), "NICK ")
+	s.expect("USER ")
+	s.send(":irc.test 001 " + nick + " :Welcome " + nick + "!goirc@127.0.0.1")
+	if nick != "bot" {
+		s.expect("NICK bot")
+	}
+
+	status := waitForStatus(t, g, func(status GatewayStatus) bool {
+		return status.State == Connected
+	})
+	if status.State != Connected {
+		t.Errorf("Status() = %v, want Connected after reconnecting", status.State)
+	}
+}
+
+// testCA is a certificate authority for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue creates a certificate for 127.0.0.1, or a client certificate.
+func (ca *testCA) issue(t *testing.T, client bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "bot"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		tmpl.IPAddresses = nil
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,241 @@
+package chatbot
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	saslPlain    = "PLAIN"
+	saslExternal = "EXTERNAL"
+
+	// ircCapScheme is the proxy URL scheme which makes goirc dial through
+	// an ircCapDialer.
+	ircCapScheme = "chatbot-irc-cap"
+)
+
+func init() {
+	proxy.RegisterDialerType(ircCapScheme, ircCapDialers.dialer)
+}
+
+// ircCapDialer dials an irc server and requests capabilities before goirc
+// sends NICK and USER, so the server suspends registration until CAP END.
+// goirc registers as soon as it connects, and has no other way to send
+// anything first.
+type ircCapDialer struct {
+	forward proxy.Dialer
+	// tls is used to connect with TLS, in place of goirc's.
+	tls  *tls.Config
+	caps string
+	// dialed is called with each connection made.
+	dialed func(conn net.Conn)
+}
+
+// Dial connects to the server and sends the capability request.
+func (d ircCapDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.tls != nil {
+		conn = tls.Client(conn, d.tls)
+	}
+
+	if _, err := io.WriteString(conn, "CAP REQ :"+d.caps+"\r\n"); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "request irc capabilities")
+	}
+
+	if d.dialed != nil {
+		d.dialed(conn)
+	}
+	return conn, nil
+}
+
+// ircCapDialerSet holds the dialers of each gateway, by the host of the
+// proxy URL goirc is configured with.
+type ircCapDialerSet struct {
+	mu      sync.Mutex
+	next    int
+	dialers map[string]ircCapDialer
+}
+
+var ircCapDialers = &ircCapDialerSet{dialers: make(map[string]ircCapDialer)}
+
+// Add stores a dialer and returns the proxy URL which selects it, and a
+// function which removes it.
+func (s *ircCapDialerSet) Add(d ircCapDialer) (string, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	host := strconv.Itoa(s.next)
+	s.dialers[host] = d
+	return ircCapScheme + "://" + host, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.dialers, host)
+	}
+}
+
+// dialer returns the dialer selected by a proxy URL.
+func (s *ircCapDialerSet) dialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	s.mu.Lock()
+	d, ok := s.dialers[u.Host]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("unknown irc dialer %q", u.Host)
+	}
+
+	d.forward = forward
+	return d, nil
+}
+
+// handleSASL configures conn to authenticate with SASL during
+// registration. The capability request is sent by an ircCapDialer, and
+// the rest of the exchange by handlers added to conn. The connection is
+// dropped if authentication fails, as the bot would otherwise use a nick
+// it doesn't own. The returned function removes the dialer and handlers.
+func (g *IRCGateway) handleSASL(conn *irc.Conn) (func(), error) {
+	mechanism := strings.ToUpper(g.cfg.SASLMechanism)
+	switch mechanism {
+	case "":
+		return func() {}, nil
+	case saslPlain:
+		if g.cfg.SASLUser == "" || g.cfg.SASLPassword == "" {
+			return nil, errors.New("SASL PLAIN requires a user and password")
+		}
+	case saslExternal:
+		if g.cfg.CertFile == "" {
+			return nil, errors.New("SASL EXTERNAL requires a client certificate")
+		}
+	default:
+		return nil, errors.Errorf("unsupported SASL mechanism %q", g.cfg.SASLMechanism)
+	}
+
+	// socket is the current connection, closed to drop it. goirc has no
+	// way to close a connection itself.
+	var socket atomic.Value
+	cfg := conn.Config()
+	d := ircCapDialer{
+		caps: "sasl",
+		dialed: func(conn net.Conn) {
+			socket.Store(conn)
+		},
+	}
+	if cfg.SSL {
+		// goirc picks the port from cfg.SSL, which the dialer replaces.
+		if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+			cfg.Server = net.JoinHostPort(cfg.Server, "6697")
+		}
+		d.tls, cfg.SSL = cfg.SSLConfig, false
+	}
+	proxyURL, removeDialer := ircCapDialers.Add(d)
+	cfg.Proxy = proxyURL
+
+	fail := func(err error) {
+		g.logger.WithError(err).Error("SASL authentication failed, disconnecting")
+		g.dropConnection(err)
+		if c, ok := socket.Load().(net.Conn); ok {
+			c.Close()
+		}
+	}
+
+	// authenticated is set once SASL succeeds on the current connection.
+	var authenticated int32
+	var handlers ircHandlers
+	handlers.add(conn, irc.REGISTER,
+		func(conn *irc.Conn, line *irc.Line) {
+			atomic.StoreInt32(&authenticated, 0)
+		})
+
+	handlers.add(conn, "CAP",
+		func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) < 3 || !strings.Contains(line.Args[2], "sasl") {
+				return
+			}
+
+			switch line.Args[1] {
+			case "ACK":
+				conn.Raw("AUTHENTICATE " + mechanism)
+			case "NAK":
+				fail(errors.New("server does not support SASL"))
+			}
+		})
+
+	handlers.add(conn, "AUTHENTICATE",
+		func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) == 0 || line.Args[0] != "+" {
+				return
+			}
+
+			if mechanism == saslExternal {
+				conn.Raw("AUTHENTICATE +")
+				return
+			}
+
+			payload := g.cfg.SASLUser + "\x00" + g.cfg.SASLUser + "\x00" + g.cfg.SASLPassword
+			for _, chunk := range saslChunks(base64.StdEncoding.EncodeToString([]byte(payload))) {
+				conn.Raw("AUTHENTICATE " + chunk)
+			}
+		})
+
+	// RPL_SASLSUCCESS
+	handlers.add(conn, "903",
+		func(conn *irc.Conn, line *irc.Line) {
+			g.logger.Info("authenticated with SASL")
+			atomic.StoreInt32(&authenticated, 1)
+			conn.Raw("CAP END")
+		})
+
+	// ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED and ERR_SASLALREADY
+	for _, numeric := range []string{"904", "905", "906", "907"} {
+		handlers.add(conn, numeric,
+			func(conn *irc.Conn, line *irc.Line) {
+				fail(errors.Errorf("SASL authentication failed: %s", line.Text()))
+			})
+	}
+
+	// RPL_WELCOME. Servers which don't support capabilities ignore the
+	// request and finish registering without authentication.
+	handlers.add(conn, "001",
+		func(conn *irc.Conn, line *irc.Line) {
+			if atomic.LoadInt32(&authenticated) == 0 {
+				fail(errors.New("registered without SASL authentication"))
+			}
+		})
+
+	return func() {
+		handlers.remove()
+		removeDialer()
+	}, nil
+}
+
+// saslChunks splits an encoded SASL response into the 400 byte chunks
+// AUTHENTICATE accepts. A response which is a multiple of 400 bytes is
+// terminated with "+".
+func saslChunks(encoded string) []string {
+	var chunks []string
+	for len(encoded) >= 400 {
+		chunks = append(chunks, encoded[:400])
+		encoded = encoded[400:]
+	}
+
+	if encoded == "" {
+		encoded = "+"
+	}
+	return append(chunks, encoded)
+}
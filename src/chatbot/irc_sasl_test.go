@@ -0,0 +1,30 @@
+package chatbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSASLChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    []string
+	}{
+		{name: "empty", encoded: "", want: []string{"+"}},
+		{name: "short", encoded: "abc", want: []string{"abc"}},
+		{name: "one under", encoded: strings.Repeat("a", 399), want: []string{strings.Repeat("a", 399)}},
+		{name: "exactly 400", encoded: strings.Repeat("a", 400), want: []string{strings.Repeat("a", 400), "+"}},
+		{name: "one over", encoded: strings.Repeat("a", 400) + "b", want: []string{strings.Repeat("a", 400), "b"}},
+		{name: "exactly 800", encoded: strings.Repeat("a", 800), want: []string{strings.Repeat("a", 400), strings.Repeat("a", 400), "+"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := saslChunks(tt.encoded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("saslChunks() = %d chunks %q, want %d chunks %q", len(got), got, len(tt.want), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package chatbot
+
+import "fmt"
+
+// Joiner is implemented by gateways which can join and leave channels
+// while running.
+type Joiner interface {
+	Join(channel Destination, key string) error
+	Part(channel Destination) error
+}
+
+// joinCommand makes the bot join a channel on the gateway it was invoked
+// from.
+type joinCommand struct{}
+
+var _ Command = (*joinCommand)(nil)
+var _ Describer = (*joinCommand)(nil)
+var _ ArgSpecifier = (*joinCommand)(nil)
+var _ RoleRequirer = (*joinCommand)(nil)
+
+func (joinCommand) Name() string       { return "join" }
+func (joinCommand) Aliases() []string  { return nil }
+func (joinCommand) Usage() string      { return "" }
+func (joinCommand) Synopsis() string   { return "Join a channel." }
+func (joinCommand) RequiredRole() Role { return RoleAdmin }
+
+func (joinCommand) Examples() []string {
+	return []string{"join #twiki", "join #secret hunter2"}
+}
+
+func (joinCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{Name: "channel"},
+			{Name: "key", Help: "The channel's key, if it has one.", Optional: true},
+		},
+	}
+}
+
+func (joinCommand) Handle(args Args) (State, error) {
+	channel := Destination(args.String("channel"))
+	return func(e Event) State {
+		j, ok := e.Gateway.(Joiner)
+		if !ok {
+			e.Reply(fmt.Sprintf("%s can't join channels", e.Gateway.Name()))
+			return nil
+		}
+
+		if err := j.Join(channel, args.String("key")); err != nil {
+			e.Reply(fmt.Sprintf("unable to join %s: %v", channel, err))
+			return nil
+		}
+
+		e.Reply("joined " + string(channel))
+		return nil
+	}, nil
+}
+
+// partCommand makes the bot leave a channel on the gateway it was invoked
+// from.
+type partCommand struct{}
+
+var _ Command = (*partCommand)(nil)
+var _ Describer = (*partCommand)(nil)
+var _ ArgSpecifier = (*partCommand)(nil)
+var _ RoleRequirer = (*partCommand)(nil)
+
+func (partCommand) Name() string       { return "part" }
+func (partCommand) Aliases() []string  { return []string{"leave"} }
+func (partCommand) Usage() string      { return "" }
+func (partCommand) Synopsis() string   { return "Leave a channel." }
+func (partCommand) RequiredRole() Role { return RoleAdmin }
+
+func (partCommand) Examples() []string {
+	return []string{"part #twiki", "part"}
+}
+
+func (partCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{Name: "channel", Help: "Defaults to the current channel.", Optional: true},
+		},
+	}
+}
+
+func (partCommand) Handle(args Args) (State, error) {
+	return func(e Event) State {
+		j, ok := e.Gateway.(Joiner)
+		if !ok {
+			e.Reply(fmt.Sprintf("%s can't leave channels", e.Gateway.Name()))
+			return nil
+		}
+
+		channel := e.Message.Channel
+		if args.Has("channel") {
+			channel = Destination(args.String("channel"))
+		}
+
+		// Reply before leaving in case the reply goes to the channel.
+		if err := e.Reply("leaving " + string(channel)); err != nil {
+			return errorState(err)
+		}
+		if err := j.Part(channel); err != nil {
+			e.Reply(fmt.Sprintf("unable to leave %s: %v", channel, err))
+		}
+
+		return nil
+	}, nil
+}
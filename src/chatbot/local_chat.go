@@ -0,0 +1,663 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// localClientBufferSize is how many lines can be waiting to be written
+	// to a client before it is disconnected for falling behind.
+	localClientBufferSize = 64
+	// maxNickLength is the longest nickname or room name a local client
+	// may use.
+	maxNickLength = 32
+	// localMaxQueuedEvents is how many events can be waiting for the bot
+	// before new ones are dropped.
+	localMaxQueuedEvents = 1024
+	// localFlushTimeout is how long lines still queued for a client are
+	// written for once it is being disconnected.
+	localFlushTimeout = time.Second
+)
+
+var (
+	errNickInvalid = errors.New("nicknames must be 1 to 32 characters without spaces, and can't start with / or #")
+	errNickTaken   = errors.New("that nickname is taken")
+	errRoomInvalid = errors.New("room names must start with # and be 2 to 32 characters without spaces")
+	errNoRoom      = errors.New("you are not in a room, /join one")
+)
+
+// localMessage is a line of chat sent by a client.
+type localMessage struct {
+	sender *localClient
+	msg    string
+	// to is the nickname of the recipient of a private message.
+	to string
+	// action is true for "/me" messages.
+	action bool
+	sent   time.Time
+}
+
+// localTell is a message from the bot.
+type localTell struct {
+	// dest is a nickname or room, or "" to send to every client.
+	dest  Destination
+	msg   string
+	reply chan error
+}
+
+// localJoin registers a client under a nickname.
+type localJoin struct {
+	client *localClient
+	nick   string
+	reply  chan error
+}
+
+// localLeave unregisters a client.
+type localLeave struct {
+	client *localClient
+	reason string
+}
+
+// localCommand is a client command which changes or reports the state of
+// the chat, e.g. "/nick" or "/join".
+type localCommand struct {
+	client *localClient
+	name   string
+	arg    string
+}
+
+type chatChans struct {
+	msg  chan localMessage
+	tell chan localTell
+	add  chan localJoin
+	rm   chan localLeave
+	cmd  chan localCommand
+}
+
+func newChatChans() *chatChans {
+	return &chatChans{
+		msg:  make(chan localMessage),
+		tell: make(chan localTell),
+		add:  make(chan localJoin),
+		rm:   make(chan localLeave),
+		cmd:  make(chan localCommand),
+	}
+}
+
+// localClient is a connected client. Its nick and room are owned by
+// handleMessages.
+type localClient struct {
+	conn net.Conn
+	out  chan string
+	nick string
+	// room is the room the client's messages are sent to, or nil if the
+	// client isn't in any room.
+	room *localRoom
+}
+
+func newLocalClient(conn net.Conn) *localClient {
+	return &localClient{
+		conn: conn,
+		out:  make(chan string, localClientBufferSize),
+	}
+}
+
+// Write queues a line to be written to the client.
+func (l *localClient) Write(msg string) {
+	l.queue(strings.TrimRight(msg, "\n") + "\n")
+}
+
+// queue queues msg to be written to the client. Clients which fall too far
+// behind are disconnected.
+func (l *localClient) queue(msg string) {
+	select {
+	case l.out <- msg:
+	default:
+		l.conn.Close()
+	}
+}
+
+// writeLoop writes queued lines to the client until done is closed, and
+// then writes the lines still queued, such as the reason the client is
+// being disconnected.
+func (l *localClient) writeLoop(done <-chan struct{}) {
+	for {
+		select {
+		case msg := <-l.out:
+			if _, err := l.conn.Write([]byte(msg)); err != nil {
+				return
+			}
+		case <-done:
+			l.flush()
+			return
+		}
+	}
+}
+
+// flush writes the lines queued for the client, taking no longer than
+// localFlushTimeout.
+func (l *localClient) flush() {
+	if err := l.conn.SetWriteDeadline(time.Now().Add(localFlushTimeout)); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case msg := <-l.out:
+			if _, err := l.conn.Write([]byte(msg)); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// validNick returns an error if nick can't be used as a nickname.
+func validNick(nick string) error {
+	if nick == "" || len(nick) > maxNickLength ||
+		strings.ContainsAny(nick, " \t") || strings.HasPrefix(nick, "/") || strings.HasPrefix(nick, "#") {
+		return errNickInvalid
+	}
+
+	return nil
+}
+
+// validRoom returns an error if name can't be used as a room name.
+func validRoom(name string) error {
+	if len(name) < 2 || len(name) > maxNickLength || name[0] != '#' || strings.ContainsAny(name, " \t") {
+		return errRoomInvalid
+	}
+
+	return nil
+}
+
+// localRoom is a named room clients chat in.
+type localRoom struct {
+	name    string
+	members map[*localClient]bool
+}
+
+// broadcast writes msg to every member except skip.
+func (r *localRoom) broadcast(msg string, skip *localClient) {
+	for client := range r.members {
+		if client != skip {
+			client.Write(msg)
+		}
+	}
+}
+
+// localChat is the state of the local chat, owned by handleMessages.
+type localChat struct {
+	clients map[*localClient]bool
+	// nicks maps lower cased nicknames to clients.
+	nicks map[string]*localClient
+	// rooms maps lower cased room names to rooms. Rooms other than the
+	// local channel are removed when their last member leaves.
+	rooms map[string]*localRoom
+}
+
+// byNick returns the client using nick.
+func (c *localChat) byNick(nick string) (*localClient, bool) {
+	client, ok := c.nicks[strings.ToLower(nick)]
+	return client, ok
+}
+
+// room returns the room called name.
+func (c *localChat) room(name string) (*localRoom, bool) {
+	r, ok := c.rooms[strings.ToLower(name)]
+	return r, ok
+}
+
+// roomsOf returns the rooms client is a member of, sorted by name.
+func (c *localChat) roomsOf(client *localClient) []*localRoom {
+	var rooms []*localRoom
+	for _, r := range c.rooms {
+		if r.members[client] {
+			rooms = append(rooms, r)
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].name < rooms[j].name
+	})
+	return rooms
+}
+
+// broadcast writes msg to every client except skip.
+func (c *localChat) broadcast(msg string, skip *localClient) {
+	for client := range c.clients {
+		if client != skip {
+			client.Write(msg)
+		}
+	}
+}
+
+func (g *LocalGateway) handleMessages(ctx context.Context, cc *chatChans) {
+	chat := &localChat{
+		clients: make(map[*localClient]bool),
+		nicks:   make(map[string]*localClient),
+		rooms: map[string]*localRoom{
+			localChannel: {name: localChannel, members: make(map[*localClient]bool)},
+		},
+	}
+
+	for {
+		select {
+		case msg := <-cc.msg:
+			g.deliver(ctx, chat, msg)
+
+		case t := <-cc.tell:
+			t.reply <- g.tell(chat, t)
+
+		case join := <-cc.add:
+			if err := g.claimNick(chat, join.nick, nil); err != nil {
+				join.reply <- err
+				continue
+			}
+
+			join.client.nick = join.nick
+			chat.clients[join.client] = true
+			chat.nicks[strings.ToLower(join.nick)] = join.client
+			join.reply <- nil
+
+			g.joinRoom(ctx, chat, join.client, localChannel)
+
+		case leave := <-cc.rm:
+			if !chat.clients[leave.client] {
+				continue
+			}
+
+			delete(chat.clients, leave.client)
+			delete(chat.nicks, strings.ToLower(leave.client.nick))
+			for _, r := range chat.roomsOf(leave.client) {
+				g.partRoom(ctx, chat, leave.client, r, leave.reason)
+			}
+
+		case cmd := <-cc.cmd:
+			g.command(ctx, chat, cmd)
+
+		case <-ctx.Done():
+			for client := range chat.clients {
+				if err := client.conn.Close(); err != nil {
+					g.logger.WithError(err).Error("could not close connection")
+				}
+			}
+			return
+		}
+	}
+}
+
+// command runs a client command.
+func (g *LocalGateway) command(ctx context.Context, chat *localChat, cmd localCommand) {
+	client := cmd.client
+
+	switch cmd.name {
+	case "/nick":
+		if err := g.claimNick(chat, cmd.arg, client); err != nil {
+			client.Write(err.Error())
+			return
+		}
+
+		old := client.nick
+		delete(chat.nicks, strings.ToLower(old))
+		client.nick = cmd.arg
+		chat.nicks[strings.ToLower(cmd.arg)] = client
+		chat.broadcast("* "+old+" is now known as "+cmd.arg, nil)
+
+	case "/join":
+		if err := validRoom(cmd.arg); err != nil {
+			client.Write(err.Error())
+			return
+		}
+		g.joinRoom(ctx, chat, client, cmd.arg)
+
+	case "/part":
+		r := client.room
+		if cmd.arg != "" {
+			r, _ = chat.room(cmd.arg)
+		}
+		switch {
+		case r == nil && cmd.arg == "":
+			client.Write(errNoRoom.Error())
+			return
+		case r == nil || !r.members[client]:
+			client.Write("you are not in " + cmd.arg)
+			return
+		}
+
+		g.partRoom(ctx, chat, client, r, "")
+		if client.room == nil {
+			client.Write(errNoRoom.Error())
+		}
+
+	case "/rooms":
+		var names []string
+		for _, r := range chat.roomsOf(client) {
+			if r == client.room {
+				names = append(names, r.name+" (current)")
+				continue
+			}
+			names = append(names, r.name)
+		}
+		if len(names) == 0 {
+			client.Write(errNoRoom.Error())
+			return
+		}
+		client.Write("* your rooms: " + strings.Join(names, ", "))
+
+	case "/who":
+		r, ok := client.room, client.room != nil
+		if cmd.arg != "" {
+			r, ok = chat.room(cmd.arg)
+		}
+		if !ok {
+			client.Write("no such room " + cmd.arg)
+			return
+		}
+
+		var nicks []string
+		for c := range r.members {
+			nicks = append(nicks, c.nick)
+		}
+		sort.Strings(nicks)
+		client.Write(fmt.Sprintf("* %d in %s: %s", len(nicks), r.name, strings.Join(nicks, ", ")))
+	}
+}
+
+// joinRoom adds client to the room called name, creating the room if it
+// doesn't exist, and makes it the client's current room.
+func (g *LocalGateway) joinRoom(ctx context.Context, chat *localChat, client *localClient, name string) {
+	r, ok := chat.room(name)
+	if !ok {
+		r = &localRoom{name: name, members: make(map[*localClient]bool)}
+		chat.rooms[strings.ToLower(name)] = r
+	}
+
+	client.room = r
+	if r.members[client] {
+		client.Write("* now talking in " + r.name)
+		return
+	}
+
+	r.members[client] = true
+	r.broadcast("* "+client.nick+" has joined "+r.name, nil)
+	g.presence(ctx, AddEvent, client, r)
+}
+
+// partRoom removes client from a room. If it was the client's current
+// room, another of its rooms becomes current. Clients which have left the
+// chat aren't told, as they may already be disconnected.
+func (g *LocalGateway) partRoom(ctx context.Context, chat *localChat, client *localClient, r *localRoom, reason string) {
+	msg := "* " + client.nick + " has left " + r.name
+	if reason != "" {
+		msg += " (" + reason + ")"
+	}
+	var skip *localClient
+	if !chat.clients[client] {
+		skip = client
+	}
+	r.broadcast(msg, skip)
+
+	delete(r.members, client)
+	if len(r.members) == 0 && r.name != localChannel {
+		delete(chat.rooms, strings.ToLower(r.name))
+	}
+	g.presence(ctx, RemoveEvent, client, r)
+
+	if client.room == r {
+		client.room = nil
+		if rooms := chat.roomsOf(client); len(rooms) > 0 {
+			client.room = rooms[0]
+		}
+	}
+}
+
+// claimNick returns an error if nick can't be used by client, which is nil
+// for a client which hasn't joined yet.
+func (g *LocalGateway) claimNick(chat *localChat, nick string, client *localClient) error {
+	if err := validNick(nick); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(nick, g.botName) {
+		return errNickTaken
+	}
+	if other, ok := chat.byNick(nick); ok && other != client {
+		return errNickTaken
+	}
+
+	return nil
+}
+
+// deliver sends a client's message to the clients it is for, and to the
+// bot. Messages which aren't private go to the sender's current room.
+func (g *LocalGateway) deliver(ctx context.Context, chat *localChat, msg localMessage) {
+	sender := msg.sender
+	userName := sender.nick
+
+	g.logger.WithFields(logrus.Fields{
+		"out":      strings.TrimSpace(msg.msg),
+		"userName": userName,
+		"to":       msg.to,
+	}).Info("sending message")
+
+	switch {
+	case msg.to != "" && strings.EqualFold(msg.to, g.botName):
+		g.message(ctx, msg, userName, Destination(userName), true)
+
+	case msg.to != "":
+		to, ok := chat.byNick(msg.to)
+		if !ok {
+			sender.Write("no such nick " + msg.to)
+			return
+		}
+		to.Write("*" + userName + "* " + msg.msg)
+
+	case sender.room == nil:
+		sender.Write(errNoRoom.Error())
+
+	case msg.action:
+		sender.room.broadcast(sender.room.name+" * "+userName+" "+msg.msg, sender)
+
+	default:
+		g.message(ctx, msg, userName, Destination(sender.room.name), false)
+		sender.room.broadcast(sender.room.name+" "+userName+": "+msg.msg, sender)
+	}
+}
+
+// tell delivers a message from the bot. Messages to a nickname are
+// private, and messages to a room are seen by its members.
+func (g *LocalGateway) tell(chat *localChat, t localTell) error {
+	g.logger.WithFields(logrus.Fields{
+		"out":  strings.TrimSpace(t.msg),
+		"dest": t.dest,
+	}).Info("telling")
+
+	dest := string(t.dest)
+	switch {
+	case dest == "":
+		chat.broadcast(g.botName+": "+t.msg, nil)
+		return nil
+	case strings.HasPrefix(dest, "#"):
+		r, ok := chat.room(dest)
+		if !ok {
+			return errors.New("no such local room " + dest)
+		}
+		r.broadcast(r.name+" "+g.botName+": "+t.msg, nil)
+		return nil
+	}
+
+	to, ok := chat.byNick(dest)
+	if !ok {
+		return errors.New("no such nick " + dest)
+	}
+	to.Write("*" + g.botName + "* " + t.msg)
+	return nil
+}
+
+// message emits a MessageEvent for a client's message.
+func (g *LocalGateway) message(ctx context.Context, msg localMessage, userName string, channel Destination, direct bool) {
+	sendEvent(ctx, g.queue, Event{
+		Type: MessageEvent,
+		Message: Message{
+			Channel:   channel,
+			UserID:    userName,
+			UserName:  userName,
+			Timestamp: msg.sent,
+			Direct:    direct,
+			Text:      msg.msg,
+			Raw:       msg,
+		},
+		Gateway: g,
+	})
+}
+
+// presence emits an AddEvent or RemoveEvent for a client joining or
+// leaving a room.
+func (g *LocalGateway) presence(ctx context.Context, t EventType, client *localClient, r *localRoom) {
+	sendEvent(ctx, g.queue, Event{
+		Type: t,
+		Message: Message{
+			Channel:   Destination(r.name),
+			UserID:    client.nick,
+			UserName:  client.nick,
+			Timestamp: time.Now(),
+			Raw:       client,
+		},
+		Gateway: g,
+	})
+}
+
+// emitEvents sends events queued by handleMessages to the bot until ctx
+// is cancelled. handleMessages mustn't wait for the bot, which may itself
+// be waiting in Tell for handleMessages, so events are always accepted
+// from queue and held until the bot is ready for them.
+func (g *LocalGateway) emitEvents(ctx context.Context, queue <-chan Event) {
+	var pending []Event
+	for {
+		var out chan<- Event
+		var next Event
+		if len(pending) > 0 {
+			out, next = g.events, pending[0]
+		}
+
+		select {
+		case e := <-queue:
+			if len(pending) >= localMaxQueuedEvents {
+				g.logger.WithField("type", e.Type).Warn("bot is not keeping up, dropped event")
+				continue
+			}
+			pending = append(pending, e)
+
+		case out <- next:
+			pending[0] = Event{}
+			pending = pending[1:]
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// localHelp describes the commands local clients can use.
+const localHelp = `commands:
+  /nick <nick>          change your nickname
+  /join <#room>         join a room, or switch to one you are in
+  /part [<#room>]       leave a room, by default the current one
+  /rooms                list the rooms you are in
+  /who [<#room>]        list who is in a room
+  /me <action>          describe what you are doing
+  /msg <nick> <message> send a private message
+  /quit [<reason>]      leave the chat
+messages go to your current room. start a message with // to send it
+starting with /`
+
+// localCommands are the commands handled by handleMessages.
+var localCommands = map[string]bool{
+	"/nick":  true,
+	"/join":  true,
+	"/part":  true,
+	"/rooms": true,
+	"/who":   true,
+}
+
+// handleInput turns a line from a client into a request for
+// handleMessages. It returns false if the client quit.
+func (g *LocalGateway) handleInput(ctx context.Context, cc *chatChans, client *localClient, line string) bool {
+	msg := localMessage{sender: client, msg: line, sent: time.Now()}
+	if !strings.HasPrefix(line, "/") {
+		return g.sendMessage(ctx, cc, msg)
+	}
+	if strings.HasPrefix(line, "//") {
+		msg.msg = line[1:]
+		return g.sendMessage(ctx, cc, msg)
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	cmd, rest := fields[0], ""
+	if len(fields) == 2 {
+		rest = strings.TrimSpace(fields[1])
+	}
+
+	switch {
+	case localCommands[cmd]:
+		select {
+		case cc.cmd <- localCommand{client: client, name: cmd, arg: rest}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	case cmd == "/me":
+		if rest == "" {
+			client.Write("usage: /me <action>")
+			return true
+		}
+		msg.msg, msg.action = rest, true
+		return g.sendMessage(ctx, cc, msg)
+	case cmd == "/msg":
+		parts := strings.SplitN(rest, " ", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			client.Write("usage: /msg <nick> <message>")
+			return true
+		}
+		msg.to, msg.msg = parts[0], strings.TrimSpace(parts[1])
+		return g.sendMessage(ctx, cc, msg)
+	case cmd == "/quit":
+		g.leave(ctx, cc, client, rest)
+		return false
+	case cmd == "/help":
+		client.Write(localHelp)
+		return true
+	default:
+		client.Write("unknown command " + cmd + ", try /help")
+		return true
+	}
+}
+
+// sendMessage sends a client's message to handleMessages. It returns false
+// if the gateway stopped.
+func (g *LocalGateway) sendMessage(ctx context.Context, cc *chatChans, msg localMessage) bool {
+	select {
+	case cc.msg <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// leave unregisters a client. Leaving more than once has no effect.
+func (g *LocalGateway) leave(ctx context.Context, cc *chatChans, client *localClient, reason string) {
+	select {
+	case cc.rm <- localLeave{client: client, reason: reason}:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,251 @@
+package chatbot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalChatUniqueNicks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{})
+	alice := loginLocal(ctx, t, g, "alice")
+
+	// Nicknames are unique regardless of case, and the bot's is taken.
+	c := connectLocal(ctx, t, g)
+	for _, tt := range []struct{ nick, reply string }{
+		{"Alice", errNickTaken.Error()},
+		{"BOT", errNickTaken.Error()},
+		{"#room", errNickInvalid.Error()},
+		{"/bob", errNickInvalid.Error()},
+		{"two words", errNickInvalid.Error()},
+	} {
+		c.prompt()
+		c.send(tt.nick + "\n")
+		c.expect(tt.reply)
+	}
+	c.prompt()
+	c.send("bob\n")
+	c.expect("* bob has joined #local")
+	c.expect("*bot* hello bob, type /help for commands")
+	alice.expect("* bob has joined #local")
+
+	c.send("/nick ALICE\n")
+	c.expect(errNickTaken.Error())
+	c.send("/nick bot\n")
+	c.expect(errNickTaken.Error())
+
+	c.send("/nick carol\n")
+	c.expect("* bob is now known as carol")
+	alice.expect("* bob is now known as carol")
+
+	// Messages follow the new nickname, and the old one is free.
+	alice.send("/msg bob hi\n")
+	alice.expect("no such nick bob")
+	alice.send("/msg carol hi\n")
+	c.expect("*alice* hi")
+
+	loginLocal(ctx, t, g, "bob")
+	alice.expect("* bob has joined #local")
+}
+
+func TestLocalChatMsgAndMe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{})
+	alice := loginLocal(ctx, t, g, "alice")
+	bob := loginLocal(ctx, t, g, "bob")
+	alice.expect("* bob has joined #local")
+
+	alice.send("/msg bob hi there\n")
+	bob.expect("*alice* hi there")
+
+	// Private messages to the bot are direct messages from the sender.
+	alice.send("/msg BOT help\n")
+	m := nextMessage(t, g)
+	if !m.Direct || m.Channel != "alice" || m.Text != "help" {
+		t.Errorf("message %+v, want a direct message from alice", m)
+	}
+
+	alice.send("/msg bob\n")
+	alice.expect("usage: /msg <nick> <message>")
+
+	// Actions go to the rest of the room, not back to the sender.
+	alice.send("/me waves\n")
+	bob.expect("#local * alice waves")
+	alice.send("/me\n")
+	alice.expect("usage: /me <action>")
+
+	// Messages go to the room and the bot, and // escapes a leading /.
+	alice.send("//etc is a path\n")
+	bob.expect("#local alice: /etc is a path")
+	if m := nextMessage(t, g); m.Text != "/etc is a path" || m.Channel != localChannel || m.Direct {
+		t.Errorf("message %+v, want %q in %s", m, "/etc is a path", localChannel)
+	}
+
+	bob.send("/quit bye\n")
+	alice.expect("* bob has left #local (bye)")
+	bob.expectClosed()
+}
+
+func TestLocalChatTell(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{})
+	alice := loginLocal(ctx, t, g, "alice")
+	bob := loginLocal(ctx, t, g, "bob")
+	alice.expect("* bob has joined #local")
+
+	tell := func(dest Destination, msg string) {
+		t.Helper()
+		if err := g.Tell(dest, msg); err != nil {
+			t.Fatalf("Tell(%q) = %v", dest, err)
+		}
+	}
+
+	// Messages to a room are seen by its members.
+	tell("#LOCAL", "hi all")
+	alice.expect("#local bot: hi all")
+	bob.expect("#local bot: hi all")
+
+	// Messages to a nickname are private.
+	tell("alice", "psst")
+	tell("Bob", "only bob")
+	alice.expect("*bot* psst")
+	bob.expect("*bot* only bob")
+
+	if err := g.Broadcast("notice"); err != nil {
+		t.Fatalf("Broadcast() = %v", err)
+	}
+	alice.expect("bot: notice")
+	bob.expect("bot: notice")
+
+	if err := g.Tell("#nowhere", "hello"); err == nil {
+		t.Error("Tell() to a missing room succeeded")
+	}
+	if err := g.Tell("nobody", "hello"); err == nil {
+		t.Error("Tell() to a missing nick succeeded")
+	}
+
+	// The bot's messages aren't sent back to it as events.
+	alice.send("marker\n")
+	if m := nextMessage(t, g); m.Text != "marker" {
+		t.Errorf("message %q, want only the client's %q", m.Text, "marker")
+	}
+}
+
+func TestLocalChatRooms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{})
+	alice := loginLocal(ctx, t, g, "alice")
+	bob := loginLocal(ctx, t, g, "bob")
+	alice.expect("* bob has joined #local")
+
+	alice.send("/join #dev\n")
+	alice.expect("* alice has joined #dev")
+	bob.send("/join #DEV\n")
+	bob.expect("* bob has joined #dev")
+	alice.expect("* bob has joined #dev")
+	expectPresence(t, g, []localPresence{
+		{AddEvent, "alice", "#local"},
+		{AddEvent, "bob", "#local"},
+		{AddEvent, "alice", "#dev"},
+		{AddEvent, "bob", "#dev"},
+	})
+
+	// Messages go to the current room, which is the channel of the event.
+	alice.send("hello dev\n")
+	bob.expect("#dev alice: hello dev")
+	if m := nextMessage(t, g); m.Channel != "#dev" || m.Text != "hello dev" {
+		t.Errorf("message %+v, want %q in #dev", m, "hello dev")
+	}
+
+	alice.send("/rooms\n")
+	alice.expect("* your rooms: #dev (current), #local")
+	alice.send("/join #local\n")
+	alice.expect("* now talking in #local")
+	alice.send("/rooms\n")
+	alice.expect("* your rooms: #dev, #local (current)")
+	alice.send("/who #dev\n")
+	alice.expect("* 2 in #dev: alice, bob")
+	alice.send("/join dev\n")
+	alice.expect(errRoomInvalid.Error())
+
+	alice.send("/part #dev\n")
+	alice.expect("* alice has left #dev")
+	bob.expect("* alice has left #dev")
+
+	// Parting the current room makes another current, and a room is
+	// removed when its last member leaves.
+	bob.send("/part\n")
+	bob.expect("* bob has left #dev")
+	bob.send("/who #dev\n")
+	bob.expect("no such room #dev")
+	bob.send("/part #dev\n")
+	bob.expect("you are not in #dev")
+	bob.send("still here\n")
+	alice.expect("#local bob: still here")
+
+	// The local channel is kept when it is empty.
+	bob.send("/part #local\n")
+	bob.expect("* bob has left #local")
+	bob.expect(errNoRoom.Error())
+	alice.expect("* bob has left #local")
+	bob.send("anyone?\n")
+	bob.expect(errNoRoom.Error())
+	alice.send("/part\n")
+	alice.expect("* alice has left #local")
+	alice.expect(errNoRoom.Error())
+	bob.send("/join #local\n")
+	bob.expect("* bob has joined #local")
+
+	expectPresence(t, g, []localPresence{
+		{RemoveEvent, "alice", "#dev"},
+		{RemoveEvent, "bob", "#dev"},
+		{RemoveEvent, "bob", "#local"},
+		{RemoveEvent, "alice", "#local"},
+		{AddEvent, "bob", "#local"},
+	})
+}
+
+// localPresence is a client joining or leaving a room.
+type localPresence struct {
+	typ     EventType
+	nick    string
+	channel Destination
+}
+
+// expectPresence checks the next presence events from g are want.
+func expectPresence(t *testing.T, g *LocalGateway, want []localPresence) {
+	t.Helper()
+	for _, w := range want {
+		e := nextPresence(t, g)
+		if e.Type != w.typ || e.Message.UserName != w.nick || e.Message.Channel != w.channel {
+			t.Errorf("got %s for %s in %s, want %s for %s in %s",
+				e.Type, e.Message.UserName, e.Message.Channel, w.typ, w.nick, w.channel)
+		}
+	}
+}
+
+// nextPresence returns the next AddEvent or RemoveEvent from g.
+func nextPresence(t *testing.T, g *LocalGateway) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-g.Events():
+			if e.Type == AddEvent || e.Type == RemoveEvent {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a presence event")
+			return Event{}
+		}
+	}
+}
@@ -2,86 +2,129 @@ package chatbot
 
 import (
 	"bufio"
+	"context"
+	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 const (
-	connBufSize = 4096
+	// localChannel is the room local clients join when they connect. It
+	// always exists, even when empty.
+	localChannel = "#local"
+
+	defaultLocalAddr           = ":8889"
+	defaultLocalMaxLineLength  = 4096
+	defaultLocalIdleTimeout    = 30 * time.Minute
+	defaultLocalMaxConnections = 100
 )
 
-type localMessage struct {
-	sender   net.Conn
-	userName string
-	msg      string
+// errLineTooLong is returned by readLine for lines over the maximum
+// length.
+var errLineTooLong = errors.New("line too long")
+
+// LocalConfig configures a LocalGateway. Zero values are replaced by
+// defaults.
+type LocalConfig struct {
+	BotName string
+	// Addr is the address to listen on. It defaults to ":8889".
+	Addr string
+	// MaxLineLength is the longest line in bytes a client may send. Longer
+	// lines are discarded. It defaults to 4096.
+	MaxLineLength int
+	// IdleTimeout disconnects clients which send nothing for the duration.
+	// It defaults to 30 minutes.
+	IdleTimeout time.Duration
+	// MaxConnections is how many clients may be connected at once, over
+	// TCP and the web client. It defaults to 100.
+	MaxConnections int
+	// HTTPAddr is the address the web client is served on. The web client
+	// is disabled if it is empty.
+	HTTPAddr string
 }
 
-type chatChans struct {
-	msg  chan localMessage
-	add  chan localClient
-	rm   chan localClient
-	stop chan bool
-}
-
-func newChatChans() *chatChans {
-	return &chatChans{
-		msg:  make(chan localMessage),
-		add:  make(chan localClient),
-		rm:   make(chan localClient),
-		stop: make(chan bool),
+// withDefaults returns the config with zero values replaced by defaults.
+func (cfg LocalConfig) withDefaults() LocalConfig {
+	if cfg.Addr == "" {
+		cfg.Addr = defaultLocalAddr
+	}
+	if cfg.MaxLineLength <= 0 {
+		cfg.MaxLineLength = defaultLocalMaxLineLength
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultLocalIdleTimeout
+	}
+	if cfg.MaxConnections <= 0 {
+		cfg.MaxConnections = defaultLocalMaxConnections
 	}
-}
-
-type localClient struct {
-	conn net.Conn
-	ch   chan<- string
-}
 
-func (l *localClient) Write(msg string) error {
-	_, err := l.conn.Write([]byte(msg))
-	return err
+	return cfg
 }
 
 // LocalGateway is a gateway for chatting locally. It takes input
-// from a TCP socket.
+// from a TCP socket, one message per line, and optionally from a web
+// client over WebSocket.
 type LocalGateway struct {
-	botName  string
-	logger   *logrus.Entry
-	cc       *chatChans
-	doneChan chan struct{}
-	events   chan Event
+	cfg     LocalConfig
+	botName string
+	logger  *logrus.Entry
+	cc      *chatChans
+	events  chan Event
+	queue   chan Event
+	images  ImageHost
+
+	mu   sync.RWMutex
+	done <-chan struct{}
+	// conns is the number of connected clients.
+	conns int32
 }
 
-var _ Gateway = (*LocalGateway)(nil)
+var (
+	_ Gateway     = (*LocalGateway)(nil)
+	_ ImageHosted = (*LocalGateway)(nil)
+)
 
 // NewLocalGateway creates an instance of LocalGateway.
-func NewLocalGateway(botName string) *LocalGateway {
+func NewLocalGateway(cfg LocalConfig) *LocalGateway {
+	cfg = cfg.withDefaults()
 	logger := logrus.WithFields(logrus.Fields{
 		"gateway": "local",
-		"botName": botName,
+		"botName": cfg.BotName,
 	})
 
 	return &LocalGateway{
-		botName: botName,
+		cfg:     cfg,
+		botName: cfg.BotName,
 		logger:  logger,
+		cc:      newChatChans(),
 		events:  make(chan Event),
+		queue:   make(chan Event),
 	}
 }
 
+// Name is the name of the gateway.
+func (g *LocalGateway) Name() string {
+	return "local"
+}
+
 // Events are events from the LocalGateway.
 func (g *LocalGateway) Events() <-chan Event {
 	return g.events
 }
 
-// Start starts the local gateway.
-func (g *LocalGateway) Start(errChan chan error) {
-	listener, err := net.Listen("tcp", ":8889")
+// Start listens for local clients until ctx is cancelled.
+func (g *LocalGateway) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", g.cfg.Addr)
 	if err != nil {
-		errChan <- err
-		return
+		return err
 	}
 
 	g.logger.WithField("addr", listener.Addr()).Info("starting listener")
@@ -90,153 +133,277 @@ func (g *LocalGateway) Start(errChan chan error) {
 		g.logger.Info("shutting down listener")
 	}()
 
-	g.cc = newChatChans()
+	g.mu.Lock()
+	g.done = ctx.Done()
+	g.mu.Unlock()
+
+	if g.cfg.HTTPAddr != "" {
+		if err := g.startWeb(ctx); err != nil {
+			listener.Close()
+			return err
+		}
+	}
 
-	go g.handleMessages(g.cc)
+	go g.emitEvents(ctx, g.queue)
+	go g.handleMessages(ctx, g.cc)
 
-	g.doneChan = make(chan struct{})
 	go func() {
-		<-g.doneChan
+		<-ctx.Done()
 		if err := listener.Close(); err != nil {
 			g.logger.WithError(err).Error("listener close failure")
 		}
-
 	}()
 
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			errChan <- err
-		}
+			if ctx.Err() != nil {
+				return nil
+			}
 
-		go g.handleConnection(conn, g.cc)
-	}
-}
+			ne, ok := err.(net.Error)
+			if !ok || !ne.Temporary() {
+				return err
+			}
 
-// Stop the local gateway.
-func (g *LocalGateway) Stop() {
-	g.logger.Info("shutting down")
-	if g.cc != nil {
-		g.cc.stop <- true
-	}
+			delay = acceptDelay(delay)
+			g.logger.WithError(err).WithField("delay", delay).Warn("accept failure")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
 
-	close(g.events)
+		delay = 0
+		if !g.admit(conn) {
+			conn.Close()
+			continue
+		}
 
-	if g.doneChan != nil {
-		g.doneChan <- struct{}{}
+		go func() {
+			defer atomic.AddInt32(&g.conns, -1)
+			g.handleConnection(ctx, conn, g.cc)
+		}()
 	}
 }
 
-func (g *LocalGateway) handleMessages(cc *chatChans) {
-	clients := make(map[net.Conn]chan<- string)
-	for {
-		select {
-		case msg := <-cc.msg:
-			g.logger.WithFields(logrus.Fields{
-				"out":      strings.TrimSpace(msg.msg),
-				"userName": msg.userName,
-			}).Info("sending message")
-
-			g.events <- Event{
-				Type:    MessageEvent,
-				Creator: msg.userName,
-				Payload: msg.msg,
-				Gateway: g,
-			}
+// admit counts a new client against the connection limit. Clients over
+// the limit are told to try again later, and admit returns false. The
+// caller must decrement g.conns when an admitted client disconnects.
+func (g *LocalGateway) admit(conn net.Conn) bool {
+	if n := atomic.AddInt32(&g.conns, 1); int(n) > g.cfg.MaxConnections {
+		atomic.AddInt32(&g.conns, -1)
+		g.logger.WithField("remote", conn.RemoteAddr()).Warn("too many connections")
+		conn.Write([]byte("too many connections, try again later\n"))
+		return false
+	}
 
-			for conn, ch := range clients {
-				if conn != msg.sender {
-					go func(userName, out string, mch chan<- string) {
-						mch <- (userName + ": " + out)
-					}(msg.userName, msg.msg, ch)
-				}
-			}
-		case client := <-cc.add:
-			g.events <- Event{
-				Type:    AddEvent,
-				Gateway: g,
-				// Creator: client.
-			}
+	return true
+}
 
-			clients[client.conn] = client.ch
-		case client := <-cc.rm:
-			delete(clients, client.conn)
-		case <-cc.stop:
-			for k := range clients {
-				if err := k.Close(); err != nil {
-					g.logger.WithError(err).Error("could not close connection")
-				}
-			}
-		}
+// acceptDelay doubles the delay after a failed accept, up to a second.
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
 	}
+	return delay
 }
 
-func (g *LocalGateway) handleConnection(conn net.Conn, cc *chatChans) {
-	ch := make(chan string)
+// doneChan returns the channel which is closed when the gateway stops, or
+// nil if it hasn't started.
+func (g *LocalGateway) doneChan() <-chan struct{} {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 
-	lc := localClient{
-		conn: conn,
-		ch:   ch,
-	}
-
-	cc.add <- lc
+	return g.done
+}
 
+func (g *LocalGateway) handleConnection(ctx context.Context, conn net.Conn, cc *chatChans) {
+	client := newLocalClient(conn)
+	done := make(chan struct{})
+	flushed := make(chan struct{})
 	defer func() {
+		close(done)
+		<-flushed
 		conn.Close()
-		cc.rm <- lc
 	}()
-
 	go func() {
-		for msg := range ch {
-			lc.Write(msg)
-		}
+		defer close(flushed)
+		client.writeLoop(done)
 	}()
 
-	buf := make([]byte, connBufSize)
-
-	lc.Write("Username?: ")
 	r := bufio.NewReader(conn)
-	userName, err := r.ReadString('\n')
-	if err != nil {
-		lc.Write("invalid username\n")
+	nick, ok := g.register(ctx, cc, client, r)
+	if !ok {
 		return
 	}
-	userName = strings.TrimSpace(userName)
+	defer g.leave(ctx, cc, client, "")
 
-	g.logger.WithField("userName", userName).Info("new connection")
+	g.logger.WithField("userName", nick).Info("new connection")
+	g.Tell(Destination(nick), "hello "+nick+", type /help for commands")
 
-	g.Tell(Destination(userName), "hello "+userName+"\n")
+	for {
+		line, err := g.readLine(conn, r)
+		switch {
+		case err == errLineTooLong:
+			client.Write(fmt.Sprintf("line too long, the limit is %d bytes", g.cfg.MaxLineLength))
+			continue
+		case isTimeout(err):
+			client.Write("disconnected for being idle")
+			g.leave(ctx, cc, client, "idle")
+			return
+		case err != nil:
+			return
+		case !utf8.ValidString(line):
+			client.Write("invalid UTF-8, line discarded")
+			continue
+		case strings.TrimSpace(line) == "":
+			continue
+		}
+
+		if !g.handleInput(ctx, cc, client, line) {
+			return
+		}
+	}
+}
 
+// register asks a client for a nickname until it gives one which is free,
+// and adds it to the chat.
+func (g *LocalGateway) register(ctx context.Context, cc *chatChans, client *localClient, r *bufio.Reader) (string, bool) {
 	for {
-		n, err := conn.Read(buf)
-		if err != nil || n == 0 {
-			break
+		client.queue("Username?: ")
+		line, err := g.readLine(client.conn, r)
+		if err == errLineTooLong {
+			client.Write(errNickInvalid.Error())
+			continue
+		}
+		if err != nil {
+			return "", false
 		}
 
-		cc.msg <- localMessage{
-			userName: userName,
-			sender:   conn,
-			msg:      string(buf[0:n]),
+		nick := strings.TrimSpace(line)
+		if err := validNick(nick); err != nil || !utf8.ValidString(nick) {
+			client.Write(errNickInvalid.Error())
+			continue
+		}
+
+		join := localJoin{client: client, nick: nick, reply: make(chan error, 1)}
+		select {
+		case cc.add <- join:
+		case <-ctx.Done():
+			return "", false
+		}
+
+		select {
+		case err := <-join.reply:
+			if err != nil {
+				client.Write(err.Error())
+				continue
+			}
+			return nick, true
+		case <-ctx.Done():
+			return "", false
 		}
 	}
 }
 
-// Tell sends a message to a destination.
-func (g *LocalGateway) Tell(dest Destination, msg string) error {
-	g.cc.msg <- localMessage{
-		userName: g.botName,
-		msg:      msg,
+// readLine reads a line from a client, without its line ending. Lines
+// longer than the maximum length are discarded and errLineTooLong is
+// returned. Clients must send a line within the idle timeout.
+func (g *LocalGateway) readLine(conn net.Conn, r *bufio.Reader) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(g.cfg.IdleTimeout)); err != nil {
+		return "", err
+	}
+
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(strings.TrimRight(string(line), "\r\n")) > g.cfg.MaxLineLength {
+				tooLong, line = true, nil
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return "", err
+		case tooLong:
+			return "", errLineTooLong
+		default:
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
 	}
+}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Addressed returns the rest of msg if it starts with the bot's name.
+func (g *LocalGateway) Addressed(msg string) (string, bool) {
+	return stripAddress(msg, g.botName)
+}
+
+// Tell sends a message to a destination: a client's nickname, or a room
+// such as "#local".
+func (g *LocalGateway) Tell(dest Destination, msg string) error {
+	return g.send(localTell{dest: dest, msg: msg})
+}
+
+// Broadcast sends a message to every client.
+func (g *LocalGateway) Broadcast(msg string) error {
+	return g.send(localTell{msg: msg})
+}
 
-	return nil
+// SetImageHost sets where images are hosted for Display.
+func (g *LocalGateway) SetImageHost(host ImageHost) {
+	g.images = host
 }
 
-// Display displays an image.
+// Display displays an image by posting a link to a hosted copy.
 func (g *LocalGateway) Display(dest Destination, imageData io.Reader) error {
-	g.cc.msg <- localMessage{
-		userName: "BOT",
-		msg:      "copy file to image server\n",
+	if g.images == nil {
+		return ErrNoImageHost
 	}
 
-	return nil
+	url, err := g.images.Host(imageData)
+	if err != nil {
+		return err
+	}
+
+	return g.Tell(dest, captionLink(imageData, url))
+}
+
+// send sends a message from the bot to the local clients.
+func (g *LocalGateway) send(t localTell) error {
+	done := g.doneChan()
+	if done == nil {
+		return ErrNotRunning
+	}
+
+	t.reply = make(chan error, 1)
+	select {
+	case g.cc.tell <- t:
+	case <-done:
+		return ErrNotRunning
+	}
+
+	select {
+	case err := <-t.reply:
+		return err
+	case <-done:
+		return ErrNotRunning
+	}
 }
@@ -0,0 +1,271 @@
+package chatbot
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startLocalGateway runs the chat of a LocalGateway configured by cfg
+// without listening for clients.
+func startLocalGateway(ctx context.Context, cfg LocalConfig) *LocalGateway {
+	cfg.BotName = "bot"
+	g := NewLocalGateway(cfg)
+	g.mu.Lock()
+	g.done = ctx.Done()
+	g.mu.Unlock()
+
+	go g.emitEvents(ctx, g.queue)
+	go g.handleMessages(ctx, g.cc)
+
+	return g
+}
+
+// startLocalChat runs the chat of a LocalGateway without listening for
+// clients, and adds a client named nick.
+func startLocalChat(ctx context.Context, t *testing.T, nick string) (*LocalGateway, *localClient) {
+	g := startLocalGateway(ctx, LocalConfig{})
+
+	conn, _ := net.Pipe()
+	client := newLocalClient(conn)
+	join := localJoin{client: client, nick: nick, reply: make(chan error, 1)}
+	g.cc.add <- join
+	if err := <-join.reply; err != nil {
+		t.Fatalf("join as %s: %v", nick, err)
+	}
+
+	return g, client
+}
+
+func TestLocalGatewayTellWhileEventsPending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, client := startLocalChat(ctx, t, "alice")
+
+	// Nothing reads the gateway's events until the bot has replied, as
+	// when the bot is busy handling an earlier event.
+	texts := []string{"one", "two", "three"}
+	for _, text := range texts {
+		if !g.sendMessage(ctx, g.cc, localMessage{sender: client, msg: text, sent: time.Now()}) {
+			t.Fatal("gateway stopped")
+		}
+	}
+
+	told := make(chan error, 1)
+	go func() { told <- g.Tell(localChannel, "hello") }()
+	select {
+	case err := <-told:
+		if err != nil {
+			t.Fatalf("Tell() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tell() blocked on pending events")
+	}
+
+	want := []Event{{Type: AddEvent}}
+	for _, text := range texts {
+		want = append(want, Event{Type: MessageEvent, Message: Message{Text: text}})
+	}
+
+	for _, w := range want {
+		select {
+		case e := <-g.Events():
+			if e.Type != w.Type || e.Message.Text != w.Message.Text {
+				t.Errorf("got %s %q, want %s %q", e.Type, e.Message.Text, w.Type, w.Message.Text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s %q", w.Type, w.Message.Text)
+		}
+	}
+}
+
+// localTestClient is the far end of a connection handled by a
+// LocalGateway.
+type localTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	// done is closed when the gateway has finished with the connection.
+	done chan struct{}
+}
+
+// connectLocal connects a client to g over a pipe.
+func connectLocal(ctx context.Context, t *testing.T, g *LocalGateway) *localTestClient {
+	server, conn := net.Pipe()
+	c := &localTestClient{t: t, conn: conn, r: bufio.NewReader(conn), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		g.handleConnection(ctx, server, g.cc)
+	}()
+
+	return c
+}
+
+// login connects a client to g and registers it as nick.
+func loginLocal(ctx context.Context, t *testing.T, g *LocalGateway, nick string) *localTestClient {
+	c := connectLocal(ctx, t, g)
+	c.prompt()
+	c.send(nick + "\n")
+	c.expect("* " + nick + " has joined #local")
+	c.expect("*bot* hello " + nick + ", type /help for commands")
+	return c
+}
+
+// send writes raw input to the gateway.
+func (c *localTestClient) send(input string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c.conn, input); err != nil {
+		c.t.Fatalf("send %q: %v", input, err)
+	}
+}
+
+// prompt reads the prompt for a nickname.
+func (c *localTestClient) prompt() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("Username?: "))
+	if _, err := io.ReadFull(c.r, buf); err != nil || string(buf) != "Username?: " {
+		c.t.Fatalf("read %q, %v, want the nickname prompt", buf, err)
+	}
+}
+
+// expect reads a line and checks it is want.
+func (c *localTestClient) expect(want string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v, want %q", err, want)
+	}
+	if got := strings.TrimRight(line, "\n"); got != want {
+		c.t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+// expectClosed checks the gateway has closed the connection.
+func (c *localTestClient) expectClosed() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := c.r.ReadString('\n'); err != io.EOF {
+		c.t.Fatalf("read %q, %v, want the connection closed", line, err)
+	}
+}
+
+// nextMessage returns the text of the next MessageEvent from g, skipping
+// presence events.
+func nextMessage(t *testing.T, g *LocalGateway) Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-g.Events():
+			if e.Type == MessageEvent {
+				return e.Message
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a message")
+			return Message{}
+		}
+	}
+}
+
+func TestLocalGatewayLineFraming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{})
+	c := loginLocal(ctx, t, g, "alice")
+
+	// Lines are split across writes, several are sent in one write, and
+	// line endings may be CRLF.
+	for _, input := range []string{"hel", "lo\nwor", "ld\r\n", "one\ntwo\n"} {
+		c.send(input)
+	}
+
+	for _, want := range []string{"hello", "world", "one", "two"} {
+		if got := nextMessage(t, g).Text; got != want {
+			t.Errorf("message %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLocalGatewayLineLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{MaxLineLength: 10})
+	c := loginLocal(ctx, t, g, "alice")
+
+	c.send("0123456789\n")
+	if got := nextMessage(t, g).Text; got != "0123456789" {
+		t.Errorf("message %q, want the line at the limit", got)
+	}
+
+	c.send("0123456789a\n")
+	c.expect("line too long, the limit is 10 bytes")
+
+	// Lines longer than the read buffer are discarded too.
+	c.send(strings.Repeat("x", 10000) + "\n")
+	c.expect("line too long, the limit is 10 bytes")
+
+	c.send("\xff\xfe\n")
+	c.expect("invalid UTF-8, line discarded")
+
+	// Blank lines are ignored, and the client can carry on.
+	c.send("\n  \nafter\n")
+	if got := nextMessage(t, g).Text; got != "after" {
+		t.Errorf("message %q, want %q", got, "after")
+	}
+}
+
+func TestLocalGatewayIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := startLocalGateway(ctx, LocalConfig{IdleTimeout: 200 * time.Millisecond})
+	c := loginLocal(ctx, t, g, "alice")
+
+	c.expect("disconnected for being idle")
+	c.expectClosed()
+
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still handled after the idle timeout")
+	}
+}
+
+func TestLocalGatewayConnectionLimit(t *testing.T) {
+	g := NewLocalGateway(LocalConfig{BotName: "bot", MaxConnections: 1})
+
+	first, _ := net.Pipe()
+	if !g.admit(first) {
+		t.Fatal("first connection refused")
+	}
+
+	server, client := net.Pipe()
+	refused := make(chan bool, 1)
+	go func() { refused <- !g.admit(server) }()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || line != "too many connections, try again later\n" {
+		t.Errorf("read %q, %v, want to be told to try later", line, err)
+	}
+	if !<-refused {
+		t.Fatal("connection over the limit admitted")
+	}
+
+	// A client disconnecting makes room.
+	atomic.AddInt32(&g.conns, -1)
+	if !g.admit(server) {
+		t.Error("connection refused after a client disconnected")
+	}
+}
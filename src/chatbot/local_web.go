@@ -0,0 +1,203 @@
+package chatbot
+
+import (
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// localWebSocketPath is where the web client connects.
+	localWebSocketPath = "/ws"
+	// localWebShutdownTimeout is how long to wait for page requests in
+	// flight when the gateway stops. WebSocket clients are disconnected
+	// by handleMessages.
+	localWebShutdownTimeout = 5 * time.Second
+)
+
+// startWeb serves the web client until ctx is cancelled. Web clients are
+// handled like TCP clients: each WebSocket frame from the browser is a
+// line of input, and each line for the client is sent as a frame.
+func (g *LocalGateway) startWeb(ctx context.Context) error {
+	listener, err := net.Listen("tcp", g.cfg.HTTPAddr)
+	if err != nil {
+		return errors.Wrap(err, "listen for web clients")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.serveWebPage)
+	mux.Handle(localWebSocketPath, websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			if !g.admit(ws) {
+				return
+			}
+			defer atomic.AddInt32(&g.conns, -1)
+			g.handleConnection(ctx, ws, g.cc)
+		},
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		g.logger.WithField("addr", listener.Addr()).Info("serving web client")
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			g.logger.WithError(err).Error("web client server failure")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), localWebShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			g.logger.WithError(err).Error("web client server shutdown failure")
+		}
+	}()
+
+	return nil
+}
+
+// serveWebPage serves the web client.
+func (g *LocalGateway) serveWebPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := localWebPageData{BotName: g.botName}
+	if u, ok := g.images.(imageURLer); ok {
+		page.ImageURL = u.URL()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := localWebPage.Execute(w, page); err != nil {
+		g.logger.WithError(err).Error("could not render web client")
+	}
+}
+
+// sameOrigin accepts WebSocket connections from pages served by the
+// gateway, so other sites can't connect their visitors to the chat.
+func sameOrigin(cfg *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(cfg, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != req.Host {
+		return errors.New("cross origin websocket request")
+	}
+
+	cfg.Origin = origin
+	return nil
+}
+
+// imageURLer is implemented by image hosts which serve every image under
+// one URL, such as ImageServer.
+type imageURLer interface {
+	URL() string
+}
+
+// localWebPageData is what the web client is rendered with. Links to
+// images under ImageURL posted by the bot are shown inline. Other links
+// are left as text, so clients don't load images from anywhere a user
+// can get the bot to repeat.
+type localWebPageData struct {
+	BotName  string
+	ImageURL string
+}
+
+// localWebPage is the web client.
+var localWebPage = template.Must(template.New("local").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>chatbot</title>
+<style>
+  body { margin: 0; font-family: monospace; display: flex; flex-direction: column; height: 100vh; }
+  #log { flex: 1; overflow-y: auto; padding: 0.5em; white-space: pre-wrap; word-wrap: break-word; }
+  #log img { display: block; max-width: 400px; max-height: 300px; margin: 0.25em 0; }
+  #log .bot { color: #005f87; }
+  #log .status { color: #888; }
+  form { display: flex; border-top: 1px solid #ccc; }
+  #input { flex: 1; font: inherit; padding: 0.5em; border: 0; }
+</style>
+</head>
+<body>
+<div id="log"></div>
+<form id="form"><input id="input" autocomplete="off" autofocus></form>
+<script>
+(function() {
+  var botName = {{.BotName}};
+  var imageURL = {{.ImageURL}};
+  var imageFile = /^[A-Za-z0-9_-]+\.(png|jpe?g|gif|webp|bmp)$/i;
+  var log = document.getElementById("log");
+  var input = document.getElementById("input");
+
+  // isImage returns true for links to images on the bot's image server.
+  function isImage(word) {
+    return imageURL !== "" && word.indexOf(imageURL) === 0 &&
+      imageFile.test(word.slice(imageURL.length));
+  }
+
+  // fromBot returns true for lines the bot sent to everyone, a room or
+  // this client.
+  function fromBot(line) {
+    var text = line.replace(/^#\S+ /, "");
+    return text.indexOf(botName + ": ") === 0 || line.indexOf("*" + botName + "* ") === 0;
+  }
+
+  function show(line, className) {
+    var div = document.createElement("div");
+    div.textContent = line;
+    if (className) {
+      div.className = className;
+    } else if (fromBot(line)) {
+      div.className = "bot";
+      line.split(/\s+/).forEach(function(word) {
+        if (isImage(word)) {
+          var img = document.createElement("img");
+          img.src = word;
+          img.alt = word;
+          div.appendChild(img);
+        }
+      });
+    }
+
+    var atBottom = log.scrollTop + log.clientHeight >= log.scrollHeight - 5;
+    log.appendChild(div);
+    if (atBottom) {
+      log.scrollTop = log.scrollHeight;
+    }
+  }
+
+  var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  var ws = new WebSocket(scheme + location.host + "/ws");
+  ws.onmessage = function(e) {
+    e.data.replace(/\n$/, "").split("\n").forEach(function(line) { show(line); });
+  };
+  ws.onclose = function() {
+    show("disconnected, reload the page to reconnect", "status");
+    input.disabled = true;
+  };
+
+  document.getElementById("form").onsubmit = function(e) {
+    e.preventDefault();
+    if (input.value.trim() !== "" && ws.readyState === WebSocket.OPEN) {
+      ws.send(input.value + "\n");
+    }
+    input.value = "";
+  };
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,49 @@
+package chatbot
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// urlessImageHost is an ImageHost without a single URL for its images.
+type urlessImageHost struct{}
+
+func (urlessImageHost) Host(imageData io.Reader) (string, error) { return "", nil }
+
+func TestLocalGatewayServeWebPage(t *testing.T) {
+	tests := []struct {
+		name string
+		host ImageHost
+		want string
+	}{
+		{name: "image server", host: NewImageServer("", "https://bot.example.com/", 0), want: `var imageURL = "https://bot.example.com/images/";`},
+		{name: "other image host", host: urlessImageHost{}, want: `var imageURL = "";`},
+		{name: "no image host", want: `var imageURL = "";`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewLocalGateway(LocalConfig{BotName: "</script>bot"})
+			if tt.host != nil {
+				g.SetImageHost(tt.host)
+			}
+
+			w := httptest.NewRecorder()
+			g.serveWebPage(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			body := w.Body.String()
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("page doesn't contain %s", tt.want)
+			}
+			if strings.Contains(body, "</script>bot") {
+				t.Error("bot name isn't escaped")
+			}
+		})
+	}
+}
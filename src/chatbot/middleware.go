@@ -0,0 +1,42 @@
+package chatbot
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Handler handles an event.
+type Handler func(e Event)
+
+// Middleware wraps a Handler. It can act on an event before and after
+// calling next, rewrite the event, or drop it by not calling next.
+type Middleware func(next Handler) Handler
+
+// chain wraps h with middlewares. The first middleware is the outermost.
+func chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// LogEvents is a Middleware which logs events and how long they took to
+// handle.
+func LogEvents(logger *logrus.Entry) Middleware {
+	return func(next Handler) Handler {
+		return func(e Event) {
+			logger.WithField("event", e).Info("received event")
+
+			start := time.Now()
+			next(e)
+
+			logger.WithFields(logrus.Fields{
+				"type":    e.Type,
+				"gateway": e.Gateway.Name(),
+				"elapsed": time.Since(start),
+			}).Debug("handled event")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package chatbot
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+// slackDirectory caches the names of a slack team's users and channels so
+// IDs can be shown as names and names can be used as destinations.
+type slackDirectory struct {
+	mu sync.RWMutex
+	// userNames and channelNames map IDs to names. userIDs and
+	// channelIDs map lower cased names to IDs.
+	userNames    map[string]string
+	userIDs      map[string]string
+	channelNames map[string]string
+	channelIDs   map[string]string
+	// ims maps user IDs to the IDs of their direct message channels.
+	ims map[string]string
+	// bots are the IDs of users which are bots.
+	bots map[string]bool
+}
+
+// newSlackDirectory creates an instance of slackDirectory.
+func newSlackDirectory() *slackDirectory {
+	return &slackDirectory{
+		userNames:    make(map[string]string),
+		userIDs:      make(map[string]string),
+		channelNames: make(map[string]string),
+		channelIDs:   make(map[string]string),
+		ims:          make(map[string]string),
+		bots:         make(map[string]bool),
+	}
+}
+
+// Load fetches the team's users and channels.
+func (d *slackDirectory) Load(api *slack.Client) error {
+	users, err := api.GetUsers()
+	if err != nil {
+		return errors.Wrap(err, "get users")
+	}
+
+	channels, err := api.GetChannels(true)
+	if err != nil {
+		return errors.Wrap(err, "get channels")
+	}
+
+	for _, u := range users {
+		d.SetUser(u)
+	}
+	for _, ch := range channels {
+		d.SetChannel(ch.ID, ch.Name)
+	}
+
+	return nil
+}
+
+// SetUser adds or updates a user.
+func (d *slackDirectory) SetUser(u slack.User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if old, ok := d.userNames[u.ID]; ok {
+		delete(d.userIDs, strings.ToLower(old))
+	}
+	if u.Deleted {
+		delete(d.userNames, u.ID)
+		delete(d.bots, u.ID)
+		return
+	}
+
+	d.userNames[u.ID] = u.Name
+	d.userIDs[strings.ToLower(u.Name)] = u.ID
+	if u.IsBot {
+		d.bots[u.ID] = true
+	} else {
+		delete(d.bots, u.ID)
+	}
+}
+
+// SetChannel adds or renames a channel.
+func (d *slackDirectory) SetChannel(id, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if old, ok := d.channelNames[id]; ok {
+		delete(d.channelIDs, strings.ToLower(old))
+	}
+
+	d.channelNames[id] = name
+	d.channelIDs[strings.ToLower(name)] = id
+}
+
+// UserName returns the name of a user, or "" if the user is unknown.
+func (d *slackDirectory) UserName(id string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.userNames[id]
+}
+
+// IsBot returns true if a user is a bot.
+func (d *slackDirectory) IsBot(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.bots[id]
+}
+
+// ChannelName returns the name of a channel, or "" if the channel is
+// unknown.
+func (d *slackDirectory) ChannelName(id string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.channelNames[id]
+}
+
+// Resolve returns the channel ID for a destination. Destinations are
+// channel IDs, "#channel" names, or "@user" names for a direct message to
+// the user.
+func (d *slackDirectory) Resolve(api *slack.Client, dest Destination) (string, error) {
+	s := string(dest)
+
+	switch {
+	case strings.HasPrefix(s, "#"):
+		d.mu.RLock()
+		id, ok := d.channelIDs[strings.ToLower(s[1:])]
+		d.mu.RUnlock()
+		if !ok {
+			return "", errors.Errorf("unknown slack channel %q", s)
+		}
+		return id, nil
+
+	case strings.HasPrefix(s, "@"):
+		d.mu.RLock()
+		userID, ok := d.userIDs[strings.ToLower(s[1:])]
+		im, hasIM := d.ims[userID]
+		d.mu.RUnlock()
+		if !ok {
+			return "", errors.Errorf("unknown slack user %q", s)
+		}
+		if hasIM {
+			return im, nil
+		}
+
+		_, _, im, err := api.OpenIMChannel(userID)
+		if err != nil {
+			return "", errors.Wrapf(err, "open direct message to %s", s)
+		}
+
+		d.mu.Lock()
+		d.ims[userID] = im
+		d.mu.Unlock()
+		return im, nil
+
+	default:
+		return s, nil
+	}
+}
@@ -1,22 +1,45 @@
 package chatbot
 
 import (
+	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
 )
 
 // SlackGateway is a gateway for chatting over slack.
 type SlackGateway struct {
 	api     *slack.Client
+	token   string
 	botName string
 	botChan string
 	logger  *logrus.Entry
 	events  chan Event
+	dir     *slackDirectory
+	httpCfg *SlackHTTPConfig
+
+	mu    sync.RWMutex
+	botID string
 }
 
-var _ Gateway = (*SlackGateway)(nil)
+var (
+	_ Gateway        = (*SlackGateway)(nil)
+	_ ThreadTeller   = (*SlackGateway)(nil)
+	_ MessageReplier = (*SlackGateway)(nil)
+	_ ActionReplier  = (*SlackGateway)(nil)
+)
 
 // NewSlackGateway creates an instance of SlackGateway.
 func NewSlackGateway(slackToken, botName, botChan string) *SlackGateway {
@@ -27,54 +50,358 @@ func NewSlackGateway(slackToken, botName, botChan string) *SlackGateway {
 
 	return &SlackGateway{
 		api:     slack.New(slackToken),
+		token:   slackToken,
 		botName: botName,
 		botChan: botChan,
 		logger:  logger,
 		events:  make(chan Event),
+		dir:     newSlackDirectory(),
 	}
 }
 
+// Name is the name of the gateway.
+func (g *SlackGateway) Name() string {
+	return "slack"
+}
+
 // Events are events from the SlackGateway.
 func (g *SlackGateway) Events() <-chan Event {
 	return g.events
 }
 
-// Start starts the slack gateway.
-func (g *SlackGateway) Start(errChan chan error) {
-	rtm := g.api.NewRTM()
-	go rtm.ManageConnection()
+// Start connects to slack and runs until ctx is cancelled. Events are
+// received over the RTM websocket, or over HTTP if ReceiveHTTP was called
+// with the Events API enabled.
+func (g *SlackGateway) Start(ctx context.Context) error {
+	if g.httpCfg != nil {
+		return g.serveHTTP(ctx, *g.httpCfg)
+	}
+
+	return g.receiveRTM(ctx)
+}
+
+// slackIgnoredSubTypes are message subtypes which aren't new messages:
+// edits, deletions and thread reply notifications.
+var slackIgnoredSubTypes = map[string]bool{
+	"message_changed": true,
+	"message_deleted": true,
+	"message_replied": true,
+}
+
+// handleEvent handles a slack event, however it was received.
+func (g *SlackGateway) handleEvent(ctx context.Context, data interface{}) {
+	switch ev := data.(type) {
+	case *slack.TeamJoinEvent:
+		g.dir.SetUser(ev.User)
 
-	for msg := range rtm.IncomingEvents {
-		switch ev := msg.Data.(type) {
-		case *slack.HelloEvent:
-			g.logger.Info("connected to slack")
+	case *slack.UserChangeEvent:
+		g.dir.SetUser(ev.User)
 
-		case *slack.MessageEvent:
-			g.events <- Event{
-				Type:    MessageEvent,
-				Creator: ev.Channel,
-				Payload: ev.Text,
-				Gateway: g,
-			}
-		}
+	case *slack.ChannelCreatedEvent:
+		g.dir.SetChannel(ev.Channel.ID, ev.Channel.Name)
+
+	case *slack.ChannelRenameEvent:
+		g.dir.SetChannel(ev.Channel.ID, ev.Channel.Name)
+
+	case *slackMessageEvent:
+		g.handleMessage(ctx, &ev.MessageEvent, ev.ThreadTimestamp)
+
+	case *slackSlashCommand:
+		sendEvent(ctx, g.events, Event{
+			Type: MessageEvent,
+			Message: Message{
+				Channel:     Destination(ev.ChannelID),
+				ChannelName: ev.ChannelName,
+				UserID:      ev.UserID,
+				UserName:    ev.UserName,
+				Timestamp:   time.Now(),
+				Direct:      true,
+				Text:        ev.Text,
+				Raw:         ev,
+			},
+			Gateway: g,
+		})
+
+	case *slack.AttachmentActionCallback:
+		sendEvent(ctx, g.events, Event{
+			Type: ActionEvent,
+			Message: Message{
+				Channel:     Destination(ev.Channel.ID),
+				ChannelName: ev.Channel.Name,
+				UserID:      ev.User.ID,
+				UserName:    ev.User.Name,
+				Timestamp:   slackTime(ev.ActionTs),
+				Text:        ev.Actions[0].Name,
+				CallbackID:  ev.CallbackID,
+				Raw:         ev,
+			},
+			Gateway: g,
+		})
 	}
 }
 
-// Stop the slack gateway.
-func (g *SlackGateway) Stop() {
+// handleMessage sends an event for a message in thread, which is empty
+// for messages which aren't in a thread.
+func (g *SlackGateway) handleMessage(ctx context.Context, ev *slack.MessageEvent, thread string) {
+	if ev.Hidden || slackIgnoredSubTypes[ev.SubType] || g.self(ev) {
+		return
+	}
+
+	userName := g.dir.UserName(ev.User)
+	if userName == "" {
+		userName = ev.Username
+	}
 
+	sendEvent(ctx, g.events, Event{
+		Type: MessageEvent,
+		Message: Message{
+			Channel:     Destination(ev.Channel),
+			ChannelName: g.dir.ChannelName(ev.Channel),
+			UserID:      ev.User,
+			UserName:    userName,
+			ThreadID:    thread,
+			Timestamp:   slackTime(ev.Timestamp),
+			Direct:      strings.HasPrefix(ev.Channel, "D"),
+			Bot:         ev.SubType == "bot_message" || ev.BotID != "" || g.dir.IsBot(ev.User),
+			Text:        ev.Text,
+			Raw:         ev,
+		},
+		Gateway: g,
+	})
+}
+
+// self returns true if a message was sent by the bot. Messages the bot
+// posts are sent as the bot's user, or as a bot message with its name.
+func (g *SlackGateway) self(ev *slack.MessageEvent) bool {
+	g.mu.RLock()
+	botID := g.botID
+	g.mu.RUnlock()
+
+	if botID != "" && ev.User == botID {
+		return true
+	}
+	if ev.SubMessage != nil && botID != "" && ev.SubMessage.User == botID {
+		return true
+	}
+
+	return ev.SubType == "bot_message" && ev.Username == g.botName
+}
+
+// setBotID sets the bot's user ID.
+func (g *SlackGateway) setBotID(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.botID = id
+}
+
+// loadDirectory loads the team's users and channels.
+func (g *SlackGateway) loadDirectory() {
+	if err := g.dir.Load(g.api); err != nil {
+		g.logger.WithError(err).Warn("unable to load users and channels")
+	}
+}
+
+// Addressed returns the rest of msg if it starts with a mention of the
+// bot, e.g. "<@U024BE7LH> weather 90210", or the bot's name.
+func (g *SlackGateway) Addressed(msg string) (string, bool) {
+	g.mu.RLock()
+	botID := g.botID
+	g.mu.RUnlock()
+
+	// Mentions are "<@U024BE7LH>", or "<@U024BE7LH|name>" with the
+	// user's name.
+	if botID != "" && (strings.HasPrefix(msg, "<@"+botID+">") || strings.HasPrefix(msg, "<@"+botID+"|")) {
+		if idx := strings.Index(msg, ">"); idx != -1 {
+			rest := strings.TrimPrefix(msg[idx+1:], ":")
+			return strings.TrimSpace(rest), true
+		}
+	}
+
+	return stripAddress(msg, g.botName)
+}
+
+// Formatter returns the formatter for slack messages.
+func (g *SlackGateway) Formatter() Formatter {
+	return slackFormatter{}
 }
 
 // Tell sends a message to a destination.
 func (g *SlackGateway) Tell(dest Destination, msg string) error {
-	params := slack.PostMessageParameters{
-		Username: g.botName,
+	return g.TellThread(dest, "", msg, false)
+}
+
+// TellThread sends a message to a thread in a destination, or to the
+// destination if thread is empty. Thread replies are also shown in the
+// channel if broadcast is true. Destinations may be channel IDs, "#channel"
+// or "@user".
+func (g *SlackGateway) TellThread(dest Destination, thread, msg string, broadcast bool) error {
+	channel, err := g.dir.Resolve(g.api, dest)
+	if err != nil {
+		return err
 	}
-	_, _, err := g.api.PostMessage(string(dest), msg, params)
-	return err
+
+	return g.postMessage(channel, thread, msg, broadcast, nil)
 }
 
-// Display displays an image.
-func (g *SlackGateway) Display(dest Destination, imageData io.Reader) error {
+// slackPostResponse is the response to chat.postMessage.
+type slackPostResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// postMessage posts a message with chat.postMessage. The vendored slack
+// client predates threads, so the request is made here. Messages are sent
+// with slack markup enabled, as they are formatted with slackFormatter.
+func (g *SlackGateway) postMessage(channel, thread, msg string, broadcast bool, attachments []slack.Attachment) error {
+	values := url.Values{
+		"token":        {g.token},
+		"channel":      {channel},
+		"text":         {msg},
+		"username":     {g.botName},
+		"unfurl_media": {"false"},
+		"mrkdwn":       {"true"},
+	}
+	if thread != "" {
+		values.Set("thread_ts", thread)
+		if broadcast {
+			values.Set("reply_broadcast", "true")
+		}
+	}
+	if attachments != nil {
+		b, err := json.Marshal(attachments)
+		if err != nil {
+			return err
+		}
+		values.Set("attachments", string(b))
+	}
+
+	resp, err := slack.HTTPClient.PostForm(slack.SLACK_API+"chat.postMessage", values)
+	if err != nil {
+		return errors.Wrap(err, "post slack message")
+	}
+	defer resp.Body.Close()
+
+	var r slackPostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return errors.Wrap(err, "decode slack response")
+	}
+	if !r.Ok {
+		return errors.New(r.Error)
+	}
 	return nil
 }
+
+// ReplyTo replies to a message. Slash commands and button clicks are
+// answered through their response URL, and messages in a thread in the
+// thread.
+func (g *SlackGateway) ReplyTo(m Message, msg string, broadcast bool) error {
+	if responseURL := slackResponseURL(m); responseURL != "" {
+		return postSlackResponse(responseURL, slackResponse{
+			ResponseType: "in_channel",
+			Text:         msg,
+		})
+	}
+
+	return g.TellThread(m.Channel, m.ThreadID, msg, broadcast)
+}
+
+// ReplyActions replies to a message with buttons for actions.
+func (g *SlackGateway) ReplyActions(m Message, msg, callbackID string, actions []Action) error {
+	attachment := slack.Attachment{
+		Fallback:   msg,
+		CallbackID: callbackID,
+	}
+	for _, a := range actions {
+		attachment.Actions = append(attachment.Actions, slack.AttachmentAction{
+			Name:  a.Name,
+			Text:  a.Label,
+			Type:  "button",
+			Value: a.Name,
+		})
+	}
+
+	if responseURL := slackResponseURL(m); responseURL != "" {
+		return postSlackResponse(responseURL, slackResponse{
+			ResponseType: "in_channel",
+			Text:         msg,
+			Attachments:  []slack.Attachment{attachment},
+		})
+	}
+
+	channel, err := g.dir.Resolve(g.api, m.Channel)
+	if err != nil {
+		return err
+	}
+
+	return g.postMessage(channel, m.ThreadID, msg, false, []slack.Attachment{attachment})
+}
+
+// slackResponseURL returns the URL a slash command or button click is
+// answered through, or "" for other messages.
+func slackResponseURL(m Message) string {
+	switch raw := m.Raw.(type) {
+	case *slackSlashCommand:
+		return raw.ResponseURL
+	case *slack.AttachmentActionCallback:
+		return raw.ResponseURL
+	default:
+		return ""
+	}
+}
+
+// Display uploads an image to a destination, given as for Tell. The title and comment of an
+// Image are shown with it.
+func (g *SlackGateway) Display(dest Destination, imageData io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(imageData, maxImageSize+1))
+	if err != nil {
+		return errors.Wrap(err, "read image")
+	}
+	if len(data) > maxImageSize {
+		return errors.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+
+	// The slack client only uploads binary files from disk.
+	ext := imageExtensions[http.DetectContentType(data)]
+	f, err := ioutil.TempFile("", "chatbot-*"+ext)
+	if err != nil {
+		return errors.Wrap(err, "create upload file")
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "write upload file")
+	}
+
+	channel, err := g.dir.Resolve(g.api, dest)
+	if err != nil {
+		return err
+	}
+
+	title, comment := imageCaption(imageData)
+	_, err = g.api.UploadFile(slack.FileUploadParameters{
+		File:           f.Name(),
+		Filename:       "image" + ext,
+		Filetype:       strings.TrimPrefix(ext, "."),
+		Title:          title,
+		InitialComment: comment,
+		Channels:       []string{channel},
+	})
+	return errors.Wrap(err, "upload image")
+}
+
+// slackTime converts a slack timestamp (e.g. "1355517523.000005") to a
+// time.
+func slackTime(ts string) time.Time {
+	f, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
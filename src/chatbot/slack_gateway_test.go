@@ -0,0 +1,229 @@
+package chatbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+// fakeSlack is a stand-in for the slack web API. Methods are answered by
+// handlers, and the requests made are recorded.
+type fakeSlack struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]func(w http.ResponseWriter, r *http.Request)
+	requests map[string][]*http.Request
+}
+
+// newFakeSlack starts a fake slack API and points the slack client at it.
+// The returned function restores the client and stops the server.
+func newFakeSlack(t *testing.T) (*fakeSlack, func()) {
+	fs := &fakeSlack{
+		handlers: make(map[string]func(w http.ResponseWriter, r *http.Request)),
+		requests: make(map[string][]*http.Request),
+	}
+	fs.Handle("auth.test", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": true, "user_id": "UBOT"})
+	})
+
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/")
+
+		fs.mu.Lock()
+		fs.requests[method] = append(fs.requests[method], r)
+		h, ok := fs.handlers[method]
+		fs.mu.Unlock()
+
+		if !ok {
+			writeJSON(w, map[string]interface{}{"ok": false, "error": "unknown_method"})
+			return
+		}
+		h(w, r)
+	}))
+
+	api := slack.SLACK_API
+	slack.SLACK_API = fs.URL + "/"
+	return fs, func() {
+		slack.SLACK_API = api
+		fs.Close()
+	}
+}
+
+// Handle sets the handler for an API method, e.g. "files.upload".
+func (fs *fakeSlack) Handle(method string, h func(w http.ResponseWriter, r *http.Request)) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handlers[method] = h
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// testPNG returns a small png image.
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestSlackGatewayDisplay(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	var query url.Values
+	var upload []byte
+	fs.Handle("files.upload", func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("upload has no file: %v", err)
+		} else {
+			upload, _ = ioutil.ReadAll(f)
+		}
+
+		writeJSON(w, map[string]interface{}{"ok": true, "file": map[string]string{"id": "F1"}})
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	g.dir.SetChannel("C024BE91L", "general")
+
+	data := testPNG(t)
+	img := Image{Reader: bytes.NewReader(data), Title: "the title", Comment: "the comment"}
+	if err := g.Display("#general", img); err != nil {
+		t.Fatalf("Display() = %v", err)
+	}
+
+	want := map[string]string{
+		"token":           "xoxb-test",
+		"channels":        "C024BE91L",
+		"title":           "the title",
+		"initial_comment": "the comment",
+		"filetype":        "png",
+		"filename":        "image.png",
+	}
+	for k, v := range want {
+		if got := query.Get(k); got != v {
+			t.Errorf("files.upload %s = %q, want %q", k, got, v)
+		}
+	}
+	if !bytes.Equal(upload, data) {
+		t.Errorf("uploaded %d bytes, want the %d byte image", len(upload), len(data))
+	}
+}
+
+func TestSlackGatewayDisplayError(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	fs.Handle("files.upload", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "not_in_channel"})
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	err := g.Display("C024BE91L", bytes.NewReader(testPNG(t)))
+	if err == nil || !strings.Contains(err.Error(), "not_in_channel") {
+		t.Errorf("Display() = %v, want the API's error", err)
+	}
+}
+
+func TestSlackGatewayDisplayUnknownChannel(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	if err := g.Display("#nowhere", bytes.NewReader(testPNG(t))); err == nil {
+		t.Error("Display() to an unknown channel succeeded")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if n := len(fs.requests["files.upload"]); n != 0 {
+		t.Errorf("files.upload called %d times, want 0", n)
+	}
+}
+
+func TestSlackGatewayTellThread(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	var posted []url.Values
+	fs.Handle("chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		posted = append(posted, r.PostForm)
+		writeJSON(w, map[string]interface{}{"ok": true})
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+
+	tests := []struct {
+		name          string
+		thread        string
+		broadcast     bool
+		wantThread    string
+		wantBroadcast string
+	}{
+		{name: "channel"},
+		{name: "channel broadcast", broadcast: true},
+		{name: "thread", thread: "1355517523.000005", wantThread: "1355517523.000005"},
+		{name: "thread broadcast", thread: "1355517523.000005", broadcast: true, wantThread: "1355517523.000005", wantBroadcast: "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posted = nil
+			if err := g.TellThread("C024BE91L", tt.thread, "hello", tt.broadcast); err != nil {
+				t.Fatalf("TellThread() = %v", err)
+			}
+			if len(posted) != 1 {
+				t.Fatalf("chat.postMessage called %d times, want 1", len(posted))
+			}
+
+			got := posted[0]
+			for k, want := range map[string]string{
+				"channel":         "C024BE91L",
+				"text":            "hello",
+				"username":        "bot",
+				"mrkdwn":          "true",
+				"thread_ts":       tt.wantThread,
+				"reply_broadcast": tt.wantBroadcast,
+			} {
+				if got.Get(k) != want {
+					t.Errorf("%s = %q, want %q", k, got.Get(k), want)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackGatewayTellThreadError(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	fs.Handle("chat.postMessage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "thread_not_found"})
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	err := g.TellThread("C024BE91L", "1355517523.000005", "hello", false)
+	if err == nil || err.Error() != "thread_not_found" {
+		t.Errorf("TellThread() = %v, want thread_not_found", err)
+	}
+}
@@ -0,0 +1,423 @@
+package chatbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+const (
+	// slackEventsPath is where the Events API posts events.
+	slackEventsPath = "/slack/events"
+	// slackCommandsPath is where slash commands are posted.
+	slackCommandsPath = "/slack/commands"
+	// slackActionsPath is where clicks on message buttons are posted.
+	slackActionsPath = "/slack/actions"
+	// slackMaxRequestSize is the largest request body accepted from slack.
+	slackMaxRequestSize = 1 << 20
+	// slackMaxRequestAge is how old a request's timestamp may be before it
+	// is rejected as a replay.
+	slackMaxRequestAge = 5 * time.Minute
+	// slackEventIDTTL is how long event IDs are remembered to ignore
+	// retries of events already received.
+	slackEventIDTTL = 10 * time.Minute
+	// slackEventQueueSize is how many received events can be waiting to
+	// be handled. Requests are acknowledged once their event is queued, so
+	// slack gets a response within its 3 second limit.
+	slackEventQueueSize = 100
+	// slackHTTPShutdownTimeout is how long to wait for requests in flight
+	// when the gateway stops.
+	slackHTTPShutdownTimeout = 5 * time.Second
+)
+
+// SlackHTTPConfig configures receiving requests from slack over HTTP.
+type SlackHTTPConfig struct {
+	// Addr is the address to listen on. Slack posts slash commands to the
+	// path "/slack/commands", button clicks to "/slack/actions" and
+	// events to "/slack/events".
+	Addr string
+	// SigningSecret is the app's signing secret, used to verify requests
+	// came from slack.
+	SigningSecret string
+	// Events receives events from the Events API instead of the RTM
+	// websocket.
+	Events bool
+}
+
+// ReceiveHTTP makes the gateway receive slash commands and button clicks
+// over HTTP, and events too if cfg.Events is set. It must be called before
+// Start.
+func (g *SlackGateway) ReceiveHTTP(cfg SlackHTTPConfig) {
+	g.httpCfg = &cfg
+}
+
+// slackEnvelope is the outer part of an Events API request.
+type slackEnvelope struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventID   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// slackSlashCommand is a slash command invocation.
+type slackSlashCommand struct {
+	Command     string
+	Text        string
+	UserID      string
+	UserName    string
+	ChannelID   string
+	ChannelName string
+	ResponseURL string
+}
+
+// slackResponse is a message sent in response to a slash command or button
+// click.
+type slackResponse struct {
+	ResponseType string             `json:"response_type,omitempty"`
+	Text         string             `json:"text,omitempty"`
+	Attachments  []slack.Attachment `json:"attachments,omitempty"`
+}
+
+// postSlackResponse sends a message to a response URL.
+func postSlackResponse(responseURL string, r slackResponse) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := slack.HTTPClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "post slack response")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("post slack response: %s", resp.Status)
+	}
+	return nil
+}
+
+// slackMessageEvent is a message received from slack, with the thread it
+// is in, which the vendored slack client doesn't decode.
+type slackMessageEvent struct {
+	slack.MessageEvent
+	ThreadTimestamp string `json:"thread_ts"`
+}
+
+// slackEventTypes create the values events are decoded into, by event
+// type.
+var slackEventTypes = map[string]func() interface{}{
+	"message":         func() interface{} { return &slackMessageEvent{} },
+	"team_join":       func() interface{} { return &slack.TeamJoinEvent{} },
+	"user_change":     func() interface{} { return &slack.UserChangeEvent{} },
+	"channel_created": func() interface{} { return &slack.ChannelCreatedEvent{} },
+	"channel_rename":  func() interface{} { return &slack.ChannelRenameEvent{} },
+}
+
+// slackReceiver receives requests from slack and queues what they carry
+// to be handled by the gateway.
+type slackReceiver struct {
+	secret string
+	queue  chan<- interface{}
+	logger *logrus.Entry
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// serveHTTP receives requests over HTTP until ctx is cancelled. Events are
+// received over the RTM websocket alongside them unless cfg.Events is set.
+func (g *SlackGateway) serveHTTP(ctx context.Context, cfg SlackHTTPConfig) error {
+	if cfg.Events {
+		auth, err := g.api.AuthTest()
+		if err != nil {
+			return errors.Wrap(err, "slack auth test")
+		}
+		g.setBotID(auth.UserID)
+		go g.loadDirectory()
+	}
+
+	queue := make(chan interface{}, slackEventQueueSize)
+	r := &slackReceiver{
+		secret: cfg.SigningSecret,
+		queue:  queue,
+		logger: g.logger,
+		seen:   make(map[string]time.Time),
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: r.handler(cfg.Events),
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		g.logger.WithField("addr", cfg.Addr).Info("receiving requests over http")
+		errs <- srv.ListenAndServe()
+	}()
+
+	rtmCtx, stopRTM := context.WithCancel(ctx)
+	rtmDone := make(chan struct{})
+	defer func() {
+		stopRTM()
+		<-rtmDone
+	}()
+	if cfg.Events {
+		close(rtmDone)
+	} else {
+		go func() {
+			defer close(rtmDone)
+			if err := g.receiveRTM(rtmCtx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			srv.Close()
+			return err
+		case data := <-queue:
+			g.handleEvent(ctx, data)
+		case <-ctx.Done():
+			g.logger.Info("shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), slackHTTPShutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		}
+	}
+}
+
+// handler routes requests from slack. Events are only accepted if events
+// is set, as they are otherwise received over the RTM websocket.
+func (r *slackReceiver) handler(events bool) http.Handler {
+	mux := http.NewServeMux()
+	if events {
+		mux.Handle(slackEventsPath, r.verified(r.serveEvent))
+	}
+	mux.Handle(slackCommandsPath, r.verified(r.serveCommand))
+	mux.Handle(slackActionsPath, r.verified(r.serveAction))
+	return mux
+}
+
+// verified wraps a handler for the body of a POST request verified to be
+// from slack.
+func (r *slackReceiver) verified(h func(w http.ResponseWriter, body []byte)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := verifySlackRequest(req, r.secret, time.Now())
+		if err != nil {
+			r.logger.WithError(err).Warn("rejected slack request")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h(w, body)
+	})
+}
+
+// serveEvent handles a request from the Events API.
+func (r *slackReceiver) serveEvent(w http.ResponseWriter, body []byte) {
+	var env slackEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	switch env.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, env.Challenge)
+		return
+	case "event_callback":
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.duplicate(env.EventID, time.Now()) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	data, err := decodeSlackEvent(env.Event)
+	if err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+	if data == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	select {
+	case r.queue <- data:
+		w.WriteHeader(http.StatusOK)
+	default:
+		// Slack retries the event later.
+		r.forget(env.EventID)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+}
+
+// serveCommand handles a slash command. The command is acknowledged so it
+// is shown in the channel, and the bot's replies are sent to its response
+// URL.
+func (r *slackReceiver) serveCommand(w http.ResponseWriter, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid command", http.StatusBadRequest)
+		return
+	}
+
+	cmd := &slackSlashCommand{
+		Command:     form.Get("command"),
+		Text:        form.Get("text"),
+		UserID:      form.Get("user_id"),
+		UserName:    form.Get("user_name"),
+		ChannelID:   form.Get("channel_id"),
+		ChannelName: form.Get("channel_name"),
+		ResponseURL: form.Get("response_url"),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	select {
+	case r.queue <- cmd:
+		json.NewEncoder(w).Encode(slackResponse{ResponseType: "in_channel"})
+	default:
+		json.NewEncoder(w).Encode(slackResponse{
+			ResponseType: "ephemeral",
+			Text:         "I'm busy, try again in a moment.",
+		})
+	}
+}
+
+// serveAction handles a click on a message button.
+func (r *slackReceiver) serveAction(w http.ResponseWriter, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	var cb slack.AttachmentActionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &cb); err != nil || len(cb.Actions) == 0 {
+		http.Error(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case r.queue <- &cb:
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+}
+
+// duplicate records an event ID and returns true if it was already
+// received, i.e. the request is a retry.
+func (r *slackReceiver) duplicate(id string, now time.Time) bool {
+	if id == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for seenID, at := range r.seen {
+		if now.Sub(at) > slackEventIDTTL {
+			delete(r.seen, seenID)
+		}
+	}
+
+	if _, ok := r.seen[id]; ok {
+		return true
+	}
+	r.seen[id] = now
+	return false
+}
+
+// forget removes an event ID, so a retry of the event is handled.
+func (r *slackReceiver) forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.seen, id)
+}
+
+// decodeSlackEvent decodes the inner event of an Events API request, or an
+// rtm message. It returns nil for event types the gateway doesn't handle.
+func decodeSlackEvent(raw json.RawMessage) (interface{}, error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+
+	newEvent, ok := slackEventTypes[header.Type]
+	if !ok {
+		return nil, nil
+	}
+
+	data := newEvent()
+	if err := json.Unmarshal(raw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// verifySlackRequest checks a request's signature and timestamp, and
+// returns its body.
+func verifySlackRequest(req *http.Request, secret string, now time.Time) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, slackMaxRequestSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "read request")
+	}
+	if len(body) > slackMaxRequestSize {
+		return nil, errors.New("request is too large")
+	}
+
+	ts := req.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("missing request timestamp")
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > slackMaxRequestAge || age < -slackMaxRequestAge {
+		return nil, errors.New("request timestamp is too old")
+	}
+
+	want := slackSignature(secret, ts, body)
+	if !hmac.Equal([]byte(req.Header.Get("X-Slack-Signature")), []byte(want)) {
+		return nil, errors.New("invalid request signature")
+	}
+
+	return body, nil
+}
+
+// slackSignature returns the signature slack sends with a request.
+func slackSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, "v0:"+ts+":")
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,288 @@
+package chatbot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// newTestReceiver creates a receiver with a queue of size n.
+func newTestReceiver(n int) (*slackReceiver, chan interface{}) {
+	queue := make(chan interface{}, n)
+	return &slackReceiver{
+		secret: testSigningSecret,
+		queue:  queue,
+		logger: logrus.WithField("test", "slack"),
+		seen:   make(map[string]time.Time),
+	}, queue
+}
+
+// signedRequest creates a request signed with secret at ts.
+func signedRequest(path, body, secret string, ts time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	req.Header.Set("X-Slack-Request-Timestamp", stamp)
+	req.Header.Set("X-Slack-Signature", slackSignature(secret, stamp, []byte(body)))
+	return req
+}
+
+// serve sends req to h and returns the response.
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func eventBody(eventID, event string) string {
+	return `{"type":"event_callback","event_id":"` + eventID + `","event":` + event + `}`
+}
+
+const testMessageEvent = `{"type":"message","channel":"C024BE91L","user":"U2147483697","text":"hello","ts":"1355517523.000005","thread_ts":"1355517500.000001"}`
+
+func TestSlackReceiverVerification(t *testing.T) {
+	r, _ := newTestReceiver(10)
+	h := r.verified(r.serveEvent)
+	body := `{"type":"url_verification","challenge":"3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}`
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{
+			name: "valid",
+			req:  signedRequest(slackEventsPath, body, testSigningSecret, time.Now()),
+			want: http.StatusOK,
+		},
+		{
+			name: "wrong secret",
+			req:  signedRequest(slackEventsPath, body, "not the secret", time.Now()),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "stale timestamp",
+			req:  signedRequest(slackEventsPath, body, testSigningSecret, time.Now().Add(-slackMaxRequestAge-time.Minute)),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "future timestamp",
+			req:  signedRequest(slackEventsPath, body, testSigningSecret, time.Now().Add(slackMaxRequestAge+time.Minute)),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "unsigned",
+			req:  httptest.NewRequest(http.MethodPost, slackEventsPath, strings.NewReader(body)),
+			want: http.StatusUnauthorized,
+		},
+		{
+			name: "GET",
+			req:  httptest.NewRequest(http.MethodGet, slackEventsPath, nil),
+			want: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(h, tt.req).Code; got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("tampered body", func(t *testing.T) {
+		req := signedRequest(slackEventsPath, body, testSigningSecret, time.Now())
+		req.Body = ioutil.NopCloser(strings.NewReader(strings.Replace(body, "3eZ", "xxx", 1)))
+		if got := serve(h, req).Code; got != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", got, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestSlackReceiverURLVerification(t *testing.T) {
+	r, queue := newTestReceiver(10)
+	body := `{"type":"url_verification","challenge":"3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}`
+
+	w := serve(r.verified(r.serveEvent), signedRequest(slackEventsPath, body, testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Body.String(), "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"; got != want {
+		t.Errorf("body = %q, want the challenge %q", got, want)
+	}
+	if len(queue) != 0 {
+		t.Errorf("%d events queued, want 0", len(queue))
+	}
+}
+
+func TestSlackReceiverMessageEvent(t *testing.T) {
+	r, queue := newTestReceiver(10)
+
+	w := serve(r.verified(r.serveEvent), signedRequest(slackEventsPath, eventBody("Ev1", testMessageEvent), testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	select {
+	case data := <-queue:
+		ev, ok := data.(*slackMessageEvent)
+		if !ok {
+			t.Fatalf("queued %T, want *slackMessageEvent", data)
+		}
+		if ev.Channel != "C024BE91L" || ev.User != "U2147483697" || ev.Text != "hello" ||
+			ev.Timestamp != "1355517523.000005" || ev.ThreadTimestamp != "1355517500.000001" {
+			t.Errorf("decoded %+v", ev)
+		}
+	default:
+		t.Fatal("no event queued")
+	}
+}
+
+func TestSlackReceiverIgnoresUnhandledEvents(t *testing.T) {
+	r, queue := newTestReceiver(10)
+
+	w := serve(r.verified(r.serveEvent), signedRequest(slackEventsPath, eventBody("Ev1", `{"type":"reaction_added"}`), testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(queue) != 0 {
+		t.Errorf("%d events queued, want 0", len(queue))
+	}
+}
+
+func TestSlackReceiverRetries(t *testing.T) {
+	r, queue := newTestReceiver(10)
+	h := r.verified(r.serveEvent)
+
+	for i := 0; i < 3; i++ {
+		w := serve(h, signedRequest(slackEventsPath, eventBody("Ev1", testMessageEvent), testSigningSecret, time.Now()))
+		if w.Code != http.StatusOK {
+			t.Fatalf("attempt %d: status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+	if got := len(queue); got != 1 {
+		t.Errorf("%d events queued for retries of one event, want 1", got)
+	}
+
+	serve(h, signedRequest(slackEventsPath, eventBody("Ev2", testMessageEvent), testSigningSecret, time.Now()))
+	if got := len(queue); got != 2 {
+		t.Errorf("%d events queued after a new event, want 2", got)
+	}
+}
+
+func TestSlackReceiverQueueFull(t *testing.T) {
+	r, queue := newTestReceiver(1)
+	h := r.verified(r.serveEvent)
+
+	serve(h, signedRequest(slackEventsPath, eventBody("Ev1", testMessageEvent), testSigningSecret, time.Now()))
+
+	w := serve(h, signedRequest(slackEventsPath, eventBody("Ev2", testMessageEvent), testSigningSecret, time.Now()))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// The retry is handled once there is room.
+	<-queue
+	w = serve(h, signedRequest(slackEventsPath, eventBody("Ev2", testMessageEvent), testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Errorf("retry status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := len(queue); got != 1 {
+		t.Errorf("%d events queued after the retry, want 1", got)
+	}
+}
+
+func TestSlackReceiverCommand(t *testing.T) {
+	r, queue := newTestReceiver(10)
+
+	form := url.Values{
+		"command":      {"/twiki"},
+		"text":         {"weather 90210"},
+		"user_id":      {"U2147483697"},
+		"user_name":    {"steve"},
+		"channel_id":   {"C024BE91L"},
+		"channel_name": {"general"},
+		"response_url": {"https://hooks.slack.com/commands/1234/5678"},
+	}
+	w := serve(r.verified(r.serveCommand), signedRequest(slackCommandsPath, form.Encode(), testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp slackResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	if resp.ResponseType != "in_channel" {
+		t.Errorf("response_type = %q, want in_channel", resp.ResponseType)
+	}
+
+	select {
+	case data := <-queue:
+		cmd, ok := data.(*slackSlashCommand)
+		if !ok {
+			t.Fatalf("queued %T, want *slackSlashCommand", data)
+		}
+		want := slackSlashCommand{
+			Command:     "/twiki",
+			Text:        "weather 90210",
+			UserID:      "U2147483697",
+			UserName:    "steve",
+			ChannelID:   "C024BE91L",
+			ChannelName: "general",
+			ResponseURL: "https://hooks.slack.com/commands/1234/5678",
+		}
+		if *cmd != want {
+			t.Errorf("decoded %+v, want %+v", *cmd, want)
+		}
+	default:
+		t.Fatal("no command queued")
+	}
+}
+
+func TestSlackReceiverHandler(t *testing.T) {
+	form := url.Values{"command": {"/twiki"}, "text": {"weather 90210"}}.Encode()
+	action := url.Values{"payload": {`{"callback_id":"c1","actions":[{"name":"yes"}],"channel":{"id":"C024BE91L"},"user":{"id":"U2147483697"}}`}}.Encode()
+
+	tests := []struct {
+		name   string
+		events bool
+		path   string
+		body   string
+		want   int
+	}{
+		{name: "command without events", path: slackCommandsPath, body: form, want: http.StatusOK},
+		{name: "action without events", path: slackActionsPath, body: action, want: http.StatusOK},
+		{name: "event without events", path: slackEventsPath, body: eventBody("Ev1", testMessageEvent), want: http.StatusNotFound},
+		{name: "command with events", events: true, path: slackCommandsPath, body: form, want: http.StatusOK},
+		{name: "action with events", events: true, path: slackActionsPath, body: action, want: http.StatusOK},
+		{name: "event with events", events: true, path: slackEventsPath, body: eventBody("Ev1", testMessageEvent), want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, queue := newTestReceiver(10)
+			w := serve(r.handler(tt.events), signedRequest(tt.path, tt.body, testSigningSecret, time.Now()))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+
+			wantQueued := 0
+			if tt.want == http.StatusOK {
+				wantQueued = 1
+			}
+			if got := len(queue); got != wantQueued {
+				t.Errorf("%d requests queued, want %d", got, wantQueued)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// slackPingInterval is how often the rtm websocket is pinged. The
+	// connection is considered lost if nothing is received for two
+	// intervals.
+	slackPingInterval = 30 * time.Second
+	// slackRTMOrigin is the origin the rtm websocket is dialed with.
+	slackRTMOrigin = "https://api.slack.com"
+)
+
+// errSlackInvalidAuth is returned when slack rejects the gateway's token.
+var errSlackInvalidAuth = errors.New("invalid slack credentials")
+
+// slackRTMFrame is the part of an rtm message used to tell what it is.
+type slackRTMFrame struct {
+	Type string `json:"type"`
+}
+
+// receiveRTM receives events over the RTM websocket until ctx is cancelled,
+// reconnecting when the connection is lost. The rtm connection is read
+// here rather than by the vendored slack client, which drops the parts of
+// events it doesn't know about, such as the thread a message is in.
+func (g *SlackGateway) receiveRTM(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		ws, err := g.dialRTM()
+		switch {
+		case err == errSlackInvalidAuth:
+			return err
+		case err != nil:
+			g.logger.WithError(err).Warn("unable to connect")
+		default:
+			attempt = 0
+			g.logger.Info("connected to slack")
+			go g.loadDirectory()
+
+			err = g.readRTM(ctx, ws)
+			if ctx.Err() != nil {
+				g.logger.Info("shutting down")
+				return nil
+			}
+			g.logger.WithError(err).Warn("disconnected")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// dialRTM starts an rtm session and connects to its websocket.
+func (g *SlackGateway) dialRTM() (*websocket.Conn, error) {
+	info, wsURL, err := g.api.StartRTM()
+	if err != nil {
+		if werr, ok := err.(*slack.WebError); ok && (*werr == "invalid_auth" || *werr == "account_inactive") {
+			return nil, errSlackInvalidAuth
+		}
+		return nil, errors.Wrap(err, "start rtm")
+	}
+	if info.User != nil {
+		g.setBotID(info.User.ID)
+	}
+
+	ws, err := websocket.Dial(wsURL, "", slackRTMOrigin)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial rtm")
+	}
+	return ws, nil
+}
+
+// readRTM handles events from an rtm websocket until it is closed, slack
+// asks the gateway to reconnect, or ctx is cancelled.
+func (g *SlackGateway) readRTM(ctx context.Context, ws *websocket.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(slackPingInterval)
+		defer ticker.Stop()
+		defer ws.Close()
+
+		for id := 1; ; id++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				ping := map[string]interface{}{"id": id, "type": "ping"}
+				if err := websocket.JSON.Send(ws, ping); err != nil {
+					g.logger.WithError(err).Debug("unable to ping")
+				}
+			}
+		}
+	}()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(2 * slackPingInterval))
+
+		var raw []byte
+		if err := websocket.Message.Receive(ws, &raw); err != nil {
+			return err
+		}
+
+		var frame slackRTMFrame
+		if err := json.Unmarshal(raw, &frame); err != nil {
+			g.logger.WithError(err).Warn("unable to decode rtm message")
+			continue
+		}
+		if frame.Type == "goodbye" {
+			return errors.New("slack asked to reconnect")
+		}
+
+		data, err := decodeSlackEvent(raw)
+		if err != nil {
+			g.logger.WithError(err).WithField("type", frame.Type).Warn("unable to decode rtm event")
+			continue
+		}
+		if data != nil {
+			g.handleEvent(ctx, data)
+		}
+	}
+}
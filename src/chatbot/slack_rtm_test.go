@@ -0,0 +1,112 @@
+package chatbot
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// handleRTM makes fs start rtm sessions on a websocket served by h.
+func handleRTM(fs *fakeSlack, h func(ws *websocket.Conn)) {
+	fs.Handle("rtm.start", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"ok":   true,
+			"url":  "ws" + strings.TrimPrefix(fs.URL, "http") + "/rtm",
+			"self": map[string]string{"id": "UBOT", "name": "bot"},
+		})
+	})
+	fs.Handle("rtm", websocket.Handler(h).ServeHTTP)
+}
+
+func TestSlackGatewayRTMThread(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	// The directory is loaded when the gateway connects, and has to be
+	// before the fake API is stopped.
+	loaded := make(chan struct{})
+	fs.Handle("users.list", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": true, "members": []interface{}{}})
+	})
+	fs.Handle("channels.list", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": true, "channels": []interface{}{}})
+		close(loaded)
+	})
+
+	handleRTM(fs, func(ws *websocket.Conn) {
+		<-loaded
+		for _, msg := range []string{
+			`{"type":"hello"}`,
+			`{"type":"message","channel":"C024BE91L","user":"UBOT","text":"from the bot","ts":"1355517522.000001"}`,
+			testMessageEvent,
+		} {
+			if err := websocket.Message.Send(ws, msg); err != nil {
+				t.Errorf("send %s: %v", msg, err)
+				return
+			}
+		}
+
+		// Wait for the gateway to hang up.
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() { errs <- g.Start(ctx) }()
+
+	select {
+	case e := <-g.Events():
+		m := e.Message
+		if m.Text != "hello" || m.UserID != "U2147483697" || m.Channel != "C024BE91L" {
+			t.Errorf("received %+v, want the message from U2147483697", m)
+		}
+		if m.ThreadID != "1355517500.000001" {
+			t.Errorf("ThreadID = %q, want %q", m.ThreadID, "1355517500.000001")
+		}
+	case err := <-errs:
+		t.Fatalf("Start() = %v before receiving a message", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Start() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after cancellation")
+	}
+}
+
+func TestSlackGatewayRTMInvalidAuth(t *testing.T) {
+	fs, stop := newFakeSlack(t)
+	defer stop()
+
+	fs.Handle("rtm.start", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+	})
+
+	g := NewSlackGateway("xoxb-test", "bot", "")
+	errs := make(chan error, 1)
+	go func() { errs <- g.Start(context.Background()) }()
+
+	select {
+	case err := <-errs:
+		if err != errSlackInvalidAuth {
+			t.Errorf("Start() = %v, want %v", err, errSlackInvalidAuth)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return for invalid credentials")
+	}
+}
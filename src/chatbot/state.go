@@ -7,38 +7,101 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-type state func(e Event) state
+// State is a step in handling an event. It returns the next step, or nil
+// when handling is complete.
+type State func(e Event) State
 
-func unknownState(fields []string) state {
-	return func(e Event) state {
-		msg := strings.Join(fields, " ")
+func unknownState(fields []string, suggestions []string) State {
+	return func(e Event) State {
+		msg := e.Prefix() + strings.Join(fields, " ")
 		logrus.WithField("command", msg).Info("unknown state")
-		e.Gateway.Tell(Destination(e.Creator), "unknown command: "+msg)
+
+		reply := "unknown command: " + msg
+		if len(suggestions) > 0 {
+			f := e.Formatter()
+			for i := range suggestions {
+				suggestions[i] = f.Bold(e.Prefix() + suggestions[i])
+			}
+			reply += "\ndid you mean " + strings.Join(suggestions, " or ") + "?"
+		}
+		e.Reply(reply)
 		return nil
 	}
 }
 
-func weatherSate(fields []string) state {
-	return func(e Event) state {
-		if len(fields) != 2 {
-			e.Gateway.Tell(Destination(e.Creator), "usage: *!weather <zip>*")
-			return nil
+func commandState(acl *ACL, cmd Command, raw []string) State {
+	return func(e Event) State {
+		if !acl.Allowed(e, cmd) {
+			return deniedState(cmd)
 		}
 
-		wr, err := weatherByZip(fields[1])
+		args, err := parseArgs(cmd, raw)
+		if err != nil {
+			return usageState(cmd, err)
+		}
+
+		s, err := cmd.Handle(args)
+		if isArgError(err) {
+			return usageState(cmd, err)
+		}
 		if err != nil {
 			return errorState(err)
 		}
 
-		msg := fmt.Sprintf("It is currently %02.fF in %s: %s\n",
-			wr.Main.Temp, fields[1], wr.WeatherFields[0].Description)
-		e.Gateway.Tell(Destination(e.Creator), msg)
+		return s
+	}
+}
 
+func deniedState(cmd Command) State {
+	return func(e Event) State {
+		logrus.WithFields(logrus.Fields{
+			"command":  cmd.Name(),
+			"identity": Identity(e),
+		}).Warn("command denied")
+		e.Reply("you are not allowed to run " + e.Prefix() + cmd.Name())
+		return nil
+	}
+}
+
+func usageState(cmd Command, err error) State {
+	return func(e Event) State {
+		msg := "usage: " + e.Formatter().Bold(usage(e.Prefix(), cmd))
+		if err != nil && err != ErrUsage {
+			msg = err.Error() + "\n" + msg
+		}
+		e.Reply(msg)
 		return nil
 	}
 }
 
-func errorState(err error) state {
+func weatherState(location string) State {
+	return func(e Event) State {
+		wr, err := weatherByLocation(location)
+		if err != nil {
+			return errorState(err)
+		}
+
+		msg := fmt.Sprintf("It is currently %02.fF in %s: %s\n",
+			wr.Main.Temp, location, wr.WeatherFields[0].Description)
+
+		refresh := []Action{{Name: "refresh", Label: "Refresh"}}
+		return Offer(msg, refresh, weatherState(location))
+	}
+}
+
+// weatherPromptState asks for a location until one is given.
+func weatherPromptState(e Event) State {
+	return Prompt("Which city or zip code?", func(e Event) State {
+		location := strings.TrimSpace(e.Message.Text)
+		if location == "" {
+			return weatherPromptState
+		}
+
+		return weatherState(location)
+	})
+}
+
+func errorState(err error) State {
 	logrus.WithError(err).Error("error state")
 	return nil
 }
@@ -0,0 +1,53 @@
+package chatbot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// statusCommand reports the connection status of the bot's gateways.
+type statusCommand struct {
+	gateways []Gateway
+}
+
+var _ Command = (*statusCommand)(nil)
+var _ Describer = (*statusCommand)(nil)
+
+func (statusCommand) Name() string       { return "status" }
+func (statusCommand) Aliases() []string  { return nil }
+func (statusCommand) Usage() string      { return "" }
+func (statusCommand) Synopsis() string   { return "Report the status of the bot's connections." }
+func (statusCommand) Examples() []string { return []string{"status"} }
+
+func (s statusCommand) Handle(args Args) (State, error) {
+	return func(e Event) State {
+		f := e.Formatter()
+
+		var lines []string
+		for _, gw := range s.gateways {
+			sr, ok := gw.(StatusReporter)
+			if !ok {
+				continue
+			}
+
+			status := sr.Status()
+			line := fmt.Sprintf("%s: %s for %s", f.Bold(gw.Name()), status.State,
+				time.Since(status.Since).Truncate(time.Second))
+			if status.Detail != "" {
+				line += " (" + status.Detail + ")"
+			}
+			if status.State != Connected && status.LastError != nil {
+				line += fmt.Sprintf(" after %d attempts: %v", status.Attempts, status.LastError)
+			}
+			lines = append(lines, line)
+		}
+
+		if len(lines) == 0 {
+			lines = append(lines, "no gateways report their status")
+		}
+
+		e.Reply(strings.Join(lines, "\n"))
+		return nil
+	}, nil
+}
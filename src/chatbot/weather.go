@@ -2,6 +2,7 @@ package chatbot
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 )
@@ -11,6 +12,43 @@ var (
 	WeatherAPIKey string
 )
 
+// weatherCommand reports the current weather.
+type weatherCommand struct{}
+
+var _ Command = (*weatherCommand)(nil)
+var _ Describer = (*weatherCommand)(nil)
+var _ ArgSpecifier = (*weatherCommand)(nil)
+
+func (weatherCommand) Name() string      { return "weather" }
+func (weatherCommand) Aliases() []string { return nil }
+func (weatherCommand) Usage() string     { return "" }
+func (weatherCommand) Synopsis() string  { return "Report the current weather." }
+
+func (weatherCommand) Examples() []string {
+	return []string{"weather 90210", `weather "San Francisco"`, "weather"}
+}
+
+func (weatherCommand) ArgSpec() ArgSpec {
+	return ArgSpec{
+		Args: []Arg{
+			{
+				Name:     "location",
+				Help:     "A US zip code or city name. You will be asked for one if it is omitted.",
+				Optional: true,
+				Variadic: true,
+			},
+		},
+	}
+}
+
+func (weatherCommand) Handle(args Args) (State, error) {
+	if !args.Has("location") {
+		return weatherPromptState, nil
+	}
+
+	return weatherState(args.String("location")), nil
+}
+
 type weatherResp struct {
 	WeatherFields []weatherWeatherResp `json:"weather"`
 	Main          weatherMainResp      `json:"main"`
@@ -24,7 +62,8 @@ type weatherMainResp struct {
 	Temp float64 `json:"temp"`
 }
 
-func weatherByZip(zip string) (*weatherResp, error) {
+// weatherByLocation fetches the weather for a US zip code or a city name.
+func weatherByLocation(location string) (*weatherResp, error) {
 	u := url.URL{
 		Scheme: "http",
 		Host:   "api.openweathermap.org",
@@ -32,7 +71,11 @@ func weatherByZip(zip string) (*weatherResp, error) {
 	}
 
 	v := u.Query()
-	v.Set("zip", zip+",us")
+	if isZip(location) {
+		v.Set("zip", location+",us")
+	} else {
+		v.Set("q", location)
+	}
 	v.Set("APPID", WeatherAPIKey)
 	v.Set("units", "imperial")
 
@@ -51,5 +94,23 @@ func weatherByZip(zip string) (*weatherResp, error) {
 		return nil, err
 	}
 
+	if len(wr.WeatherFields) == 0 {
+		return nil, fmt.Errorf("no weather found for %q", location)
+	}
+
 	return &wr, nil
 }
+
+func isZip(location string) bool {
+	if len(location) != 5 {
+		return false
+	}
+
+	for _, r := range location {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}